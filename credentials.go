@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// credentials - An access and secret key pair for the Rancher API
+type credentials struct {
+	accessKey string
+	secretKey string
+}
+
+// loadCredentials - Reads the ENV_CREDENTIALS_FILE mapping of environment IDs to API keys, a line per environment
+// of the form <environment ID>=<access key>:<secret key>. Blank lines and lines starting with # are skipped.
+// Errors name the offending line, never its keys.
+func loadCredentials(path string) (map[string]credentials, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := make(map[string]credentials)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(text, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected <environment ID>=<access key>:<secret key>", line)
+		}
+		keys := strings.SplitN(strings.TrimSpace(kv[1]), ":", 2)
+		if len(keys) != 2 || keys[0] == "" || keys[1] == "" {
+			return nil, fmt.Errorf("line %d: expected <environment ID>=<access key>:<secret key>", line)
+		}
+
+		envID := strings.TrimSpace(kv[0])
+		if _, ok := creds[envID]; ok {
+			return nil, fmt.Errorf("line %d: environment %s is mapped more than once", line, envID)
+		}
+		creds[envID] = credentials{accessKey: keys[0], secretKey: keys[1]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// credentialsFor - Returns the credentials mapped to the environment, falling back to the shared CATTLE_ACCESS_KEY and
+// CATTLE_SECRET_KEY for unmapped environments
+func credentialsFor(environmentID string) credentials {
+
+	if c, ok := envKeys[environmentID]; ok && environmentID != "" {
+		return c
+	}
+	return credentials{accessKey: accessKey, secretKey: secretKey}
+}
+
+// redact - Hides a key in logs, only telling whether one is set
+func redact(key string) string {
+
+	if key == "" {
+		return "(not set)"
+	}
+	return "(redacted)"
+}
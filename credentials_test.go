@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeCredentials - Writes the content to a credentials file in a temporary directory, returning its path
+func writeCredentials(t *testing.T, content string) string {
+
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadCredentials - Each line maps an environment to its keys, a malformed line failing without its keys in the error
+func TestLoadCredentials(t *testing.T) {
+
+	path := writeCredentials(t, "# scoped keys\n1a5=WEBACCESS:websecret\n\n 1a7 = DATAACCESS:data:secret\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	creds, err := loadCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]credentials{
+		"1a5": {accessKey: "WEBACCESS", secretKey: "websecret"},
+		"1a7": {accessKey: "DATAACCESS", secretKey: "data:secret"},
+	}
+	if !reflect.DeepEqual(creds, want) {
+		t.Errorf("got %v, want %v", creds, want)
+	}
+
+	for _, content := range []string{
+		"1a5=AK5XQ",
+		"1a5=AK5XQ:",
+		"=AK5XQ:SK5XQ",
+		"1a5 AK5XQ SK5XQ",
+		"1a5=AK5XQ:SK5XQ\n1a5=AK7ZW:SK7ZW",
+	} {
+		path := writeCredentials(t, content)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		_, err := loadCredentials(path)
+		if err == nil {
+			t.Errorf("%q: expected an error", content)
+		} else if strings.Contains(err.Error(), "AK") || strings.Contains(err.Error(), "SK") {
+			t.Errorf("%q: error %q reveals the keys", content, err)
+		}
+	}
+}
+
+// TestCredentialsFor - Mapped environments use their keys, instances may override them, everything else the shared keys
+func TestCredentialsFor(t *testing.T) {
+
+	defer func(keys map[string]credentials, access, secret string) {
+		envKeys, accessKey, secretKey = keys, access, secret
+	}(envKeys, accessKey, secretKey)
+	envKeys = map[string]credentials{"1a5": {accessKey: "WEBACCESS", secretKey: "websecret"}}
+	accessKey, secretKey = "SHAREDACCESS", "sharedsecret"
+
+	os.Setenv("CATTLE_ENVIRONMENT_ID_WEB", "1a5")
+	os.Setenv("CATTLE_ENVIRONMENT_ID_DATA", "1a7")
+	os.Setenv("CATTLE_ENVIRONMENT_ID_OPS", "1a5")
+	os.Setenv("CATTLE_ACCESS_KEY_OPS", "OPSACCESS")
+	os.Setenv("CATTLE_SECRET_KEY_OPS", "opssecret")
+	defer func() {
+		for _, key := range []string{"CATTLE_ENVIRONMENT_ID_WEB", "CATTLE_ENVIRONMENT_ID_DATA", "CATTLE_ENVIRONMENT_ID_OPS", "CATTLE_ACCESS_KEY_OPS", "CATTLE_SECRET_KEY_OPS"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	instances, err := parseInstances([]string{"web=http://rancher/v2-beta", "data=http://rancher/v2-beta", "ops=http://rancher/v2-beta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]credentials{
+		"web":  {accessKey: "WEBACCESS", secretKey: "websecret"},
+		"data": {accessKey: "SHAREDACCESS", secretKey: "sharedsecret"},
+		"ops":  {accessKey: "OPSACCESS", secretKey: "opssecret"},
+	}
+	for _, in := range instances {
+		if got := (credentials{accessKey: in.accessKey, secretKey: in.secretKey}); got != want[in.name] {
+			t.Errorf("instance %s: got %v, want %v", in.name, got, want[in.name])
+		}
+	}
+
+	if got := credentialsFor(""); got != (credentials{accessKey: "SHAREDACCESS", secretKey: "sharedsecret"}) {
+		t.Errorf("no environment: got %v, want the shared keys", got)
+	}
+	if redact("WEBACCESS") == "WEBACCESS" || redact("") == redact("WEBACCESS") {
+		t.Error("expected keys to be redacted, telling only whether one is set")
+	}
+}
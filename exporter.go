@@ -1,30 +1,107 @@
 package main
 
 import (
+	"crypto/tls"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Exporter Sets up all the runtime and metrics
 type Exporter struct {
-	rancherURL string
-	accessKey  string
-	secretKey  string
-	hideSys    bool
-	mutex      sync.RWMutex
-	gaugeVecs  map[string]*prometheus.GaugeVec
+	instance        string
+	rancherURL      string
+	socketPath      string
+	accessKey       string
+	secretKey       string
+	tlsConfig       *tls.Config
+	client          *http.Client
+	environmentID   string
+	hideSys         bool
+	staleCounts     bool
+	probeMetrics    bool
+	emitZero        bool
+	mutex           sync.RWMutex
+	gaugeVecs       map[string]*prometheus.GaugeVec
+	served          map[string]*prometheus.GaugeVec
+	refreshMutex    sync.Mutex
+	counterVecs     map[string]*prometheus.CounterVec
+	apiVersion      *apiVersion
+	scrapeVersion   *apiVersion
+	apiCalls        int
+	retries         int
+	pendingCounts   map[string][]cachedCount
+	lastCounts      map[string][]cachedCount
+	lastRefresh     time.Time
+	snapshot        snapshot
+	history         *scrapeHistory
+	probeMutex      sync.Mutex
+	lastProbe       time.Time
+	probeErr        error
+	healthThreshold int
+	stuckThreshold  time.Duration
+	transitions     map[string]transition
+	hostAgentStates map[string]string
+	envCollisions   map[[2]string]bool
+	statsd          *statsdSink
+	objectStates    map[string]map[string]int
+	refMutex        sync.RWMutex
+	envRef          map[string]string
+	stackRef        map[string]string
+	serviceRef      map[string]string
+	hostRef         map[string]string
+	avgResponse     map[string]float64
+	statsMutex      sync.Mutex
+}
+
+// apiVersion - Server version and API schema version reported by the Rancher API
+type apiVersion struct {
+	version string
+	schema  string
+}
+
+// String - Formats the version for logging
+func (v *apiVersion) String() string {
+	return v.version + " " + v.schema
 }
 
 // NewExporter creates the metrics we wish to monitor
-func newExporter(rancherURL string, accessKey string, secretKey string, hideSys bool) *Exporter {
+func newExporter(rancherURL string, accessKey string, secretKey string, tlsConfig *tls.Config, environmentID string, hideSys bool, staleCounts bool, probeMetrics bool, emitZero bool, healthWindow int, healthThreshold int, stuckThreshold time.Duration) *Exporter {
 
 	gaugeVecs := addMetrics()
-	return &Exporter{
-		gaugeVecs:  gaugeVecs,
-		rancherURL: rancherURL,
-		accessKey:  accessKey,
-		secretKey:  secretKey,
-		hideSys:    hideSys,
+	counterVecs := addCounters()
+	socketPath, rancherURL := unixSocketURL(rancherURL)
+	e := &Exporter{
+		gaugeVecs:       gaugeVecs,
+		served:          addMetrics(),
+		counterVecs:     counterVecs,
+		rancherURL:      rancherURL,
+		socketPath:      socketPath,
+		accessKey:       accessKey,
+		secretKey:       secretKey,
+		tlsConfig:       tlsConfig,
+		environmentID:   environmentID,
+		hideSys:         hideSys,
+		staleCounts:     staleCounts,
+		probeMetrics:    probeMetrics,
+		emitZero:        emitZero,
+		history:         newScrapeHistory(healthWindow),
+		healthThreshold: healthThreshold,
+		stuckThreshold:  stuckThreshold,
+		transitions:     make(map[string]transition),
+		hostAgentStates: make(map[string]string),
+		envCollisions:   make(map[[2]string]bool),
+		envRef:          make(map[string]string),
+		stackRef:        make(map[string]string),
+		serviceRef:      make(map[string]string),
+		hostRef:         make(map[string]string),
+		avgResponse:     make(map[string]float64),
+		pendingCounts:   make(map[string][]cachedCount),
+		lastCounts:      make(map[string][]cachedCount),
+		objectStates:    make(map[string]map[string]int),
 	}
+	e.client = e.newClient()
+	return e
 }
@@ -0,0 +1,63 @@
+package main
+
+import "encoding/json"
+
+// mappableFields - The metric inputs that FIELD_MAP can source from another JSON key, by their built-in key
+var mappableFields = []string{"name", "state", "healthState", "agentState", "hostname", "stackId", "accountId", "scale", "currentScale"}
+
+// decodeMapped - Decodes a response into data, then overrides the remapped fields from the raw objects.
+// Only top level keys holding a string or number can be remapped, anything else keeps the built-in value.
+func decodeMapped(raw []byte, data *Data) error {
+
+	if err := json.Unmarshal(raw, data); err != nil {
+		return err
+	}
+
+	var objects struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &objects); err != nil {
+		return err
+	}
+
+	for i, obj := range objects.Data {
+		if i >= len(data.Data) {
+			break
+		}
+		x := &data.Data[i]
+
+		for field, key := range fieldMap {
+			v, ok := obj[key]
+			if !ok {
+				continue
+			}
+
+			s, isString := v.(string)
+			n, isNumber := v.(float64)
+
+			switch {
+			case field == "name" && isString:
+				x.Name = s
+			case field == "state" && isString:
+				x.State = s
+			case field == "healthState" && isString:
+				x.HealthState = s
+			case field == "agentState" && isString:
+				x.AgentState = s
+			case field == "hostname" && isString:
+				x.HostName = s
+			case field == "stackId" && isString:
+				x.StackID = s
+			case field == "accountId" && isString:
+				x.AccountID = s
+			case field == "scale" && isNumber:
+				x.Scale = int(n)
+			case field == "currentScale" && isNumber:
+				x.CurrentScale = int(n)
+			default:
+				log.Debugf("Ignoring FIELD_MAP %s=%s, unexpected value %v", field, key, v)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// nameFilter - Include and exclude patterns matched against an object's name, either of which may be unset
+type nameFilter struct {
+	includeRule string
+	include     *regexp.Regexp
+	excludeRule string
+	exclude     *regexp.Regexp
+}
+
+// newNameFilter - Compiles the patterns of the include and exclude settings, an empty pattern being left unset
+func newNameFilter(includeRule string, include string, excludeRule string, exclude string) (nameFilter, error) {
+
+	f := nameFilter{includeRule: includeRule, excludeRule: excludeRule}
+
+	var err error
+	if include != "" {
+		if f.include, err = regexp.Compile(include); err != nil {
+			return f, fmt.Errorf("%s: %s", includeRule, err)
+		}
+	}
+	if exclude != "" {
+		if f.exclude, err = regexp.Compile(exclude); err != nil {
+			return f, fmt.Errorf("%s: %s", excludeRule, err)
+		}
+	}
+	return f, nil
+}
+
+// rejects - Returns the setting that filters the name out, or an empty string when the name passes.
+// Names must match the include pattern, when set, and not match the exclude pattern.
+func (f nameFilter) rejects(name string) string {
+
+	if f.include != nil && !f.include.MatchString(name) {
+		return f.includeRule
+	}
+	if f.exclude != nil && f.exclude.MatchString(name) {
+		return f.excludeRule
+	}
+	return ""
+}
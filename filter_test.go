@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestNameFilterRejects - Names must match the include pattern when set, and not match the exclude pattern
+func TestNameFilterRejects(t *testing.T) {
+
+	tests := []struct {
+		include string
+		exclude string
+		name    string
+		want    string
+	}{
+		{"", "", "web", ""},
+		{"", "", "", ""},
+		{"^prod-", "", "prod-web", ""},
+		{"^prod-", "", "ci-123", "STACK_FILTER"},
+		{"", "^ci-", "ci-123", "STACK_EXCLUDE"},
+		{"", "^ci-", "web-ci-1", ""},
+		{"", "ci-", "web-ci-1", "STACK_EXCLUDE"},
+		{"web", "^ci-", "ci-web", "STACK_EXCLUDE"},
+		{"^prod-", "^ci-", "staging-web", "STACK_FILTER"},
+	}
+
+	for _, tt := range tests {
+		f, err := newNameFilter("STACK_FILTER", tt.include, "STACK_EXCLUDE", tt.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.rejects(tt.name); got != tt.want {
+			t.Errorf("include %q, exclude %q: rejects(%q) = %q, want %q", tt.include, tt.exclude, tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestNewNameFilterInvalid - An invalid pattern fails, naming the setting it was read from
+func TestNewNameFilterInvalid(t *testing.T) {
+
+	for _, tt := range []struct {
+		include string
+		exclude string
+		setting string
+	}{
+		{"(", "", "SERVICE_FILTER"},
+		{"", "[a-", "SERVICE_EXCLUDE"},
+	} {
+		_, err := newNameFilter("SERVICE_FILTER", tt.include, "SERVICE_EXCLUDE", tt.exclude)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.setting+":") {
+			t.Errorf("include %q, exclude %q: expected an error naming %s, got %v", tt.include, tt.exclude, tt.setting, err)
+		}
+	}
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"crypto/tls"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/infinityworks/prometheus-rancher-exporter/measure"
@@ -15,29 +23,86 @@ import (
 // Data is used to store data from all the relevant endpoints in the API
 type Data struct {
 	Data []struct {
-		HealthState string `json:"healthState"`
-		Name        string `json:"name"`
-		State       string `json:"state"`
-		System      bool   `json:"system"`
-		Scale       int    `json:"scale"`
-		HostName    string `json:"hostname"`
-		ID          string `json:"id"`
-		StackID     string `json:"stackId"`
-		EnvID       string `json:"environmentId"`
-		BaseType    string `json:"basetype"`
-		Type        string `json:"type"`
-		AgentState  string `json:"agentState"`
+		HealthState  string            `json:"healthState"`
+		Name         string            `json:"name"`
+		State        string            `json:"state"`
+		System       bool              `json:"system"`
+		Scale        int               `json:"scale"`
+		CurrentScale int               `json:"currentScale"`
+		HostName     string            `json:"hostname"`
+		ID           string            `json:"id"`
+		StackID      string            `json:"stackId"`
+		EnvID        string            `json:"environmentId"`
+		AccountID    string            `json:"accountId"`
+		BaseType     string            `json:"basetype"`
+		Type         string            `json:"type"`
+		AgentState   string            `json:"agentState"`
+		ClusterID    string            `json:"clusterId"`
+		ProjectID    string            `json:"projectId"`
+		NamespaceID  string            `json:"namespaceId"`
+		NodeName     string            `json:"nodeName"`
+		HostID       string            `json:"hostId"`
+		StartCount   int               `json:"startCount"`
+		CN           string            `json:"cn"`
+		ExpiresAt    string            `json:"expiresAt"`
+		ServiceIDs   []string          `json:"serviceIds"`
+		ExternalIPs  []string          `json:"externalIpAddresses"`
+		Labels       map[string]string `json:"labels"`
+		LaunchConfig struct {
+			ImageUUID string `json:"imageUuid"`
+		} `json:"launchConfig"`
+		PublicEndpoints []struct {
+			Port int `json:"port"`
+		} `json:"publicEndpoints"`
 	} `json:"data"`
+	Pagination struct {
+		Next string `json:"next"`
+	} `json:"pagination"`
 }
 
 // processMetrics - Collects the data from the API, returns data object
 func (e *Exporter) processMetrics(data *Data, endpoint string, hideSys bool, ch chan<- prometheus.Metric) error {
 
+	log.Debugf("Processing metrics for %s", endpoint)
+
+	// The API doesn't guarantee ordering, sort by a stable key when deterministic output is wanted. The series are sorted
+	// on every Gather anyway, this settles which object sets a series shared by several, and the snapshot's order
+	if sortObjects {
+		sort.SliceStable(data.Data, func(i, j int) bool {
+			if data.Data[i].ID != data.Data[j].ID {
+				return data.Data[i].ID < data.Data[j].ID
+			}
+			return data.Data[i].Name < data.Data[j].Name
+		})
+	}
+
+	// Aggregates gathered while ranging through the hosts and services
+	var externalServices int
+	var desiredScale, runningScale int
+	servicesScaling := map[string]int{"up": 0, "down": 0}
+	images := make(map[string]bool)
+	publishedPorts := make(map[int]int)
+	hostsByAgentState := make(map[string]int)
+	hostsByLabel := make(map[[2]string]int)
+	envNames := make(map[string]string)
+	stackServiceHealth := make(map[[3]string]int)
+	stacksStuck := make(map[string]int)
+	objectStates := make(map[string]int)
+	seen := make(map[string]bool)
+	now := time.Now()
+
+	// Consistency guard, the series we expect to emit and why any objects were skipped
+	var expectedSeries int
+	skipped := make(map[string]int)
+
 	// Metrics - range through the data object
 	for _, x := range data.Data {
 
 		// If system services have been ignored, the loop simply skips them
-		if hideSys == true && x.System == true {
+		// unless COUNT_SYS is set, where they still count towards the aggregates without per object metrics
+		hidden := hideSys == true && x.System == true
+		if hidden && !countSys {
+			skipped["system"]++
 			continue
 		}
 
@@ -47,153 +112,857 @@ func (e *Exporter) processMetrics(data *Data, endpoint string, hideSys bool, ch
 			dataType = x.Type
 		}
 		if checkMetric(endpoint, dataType) == false {
+			skipped["type_mismatch"]++
+			continue
+		}
+
+		// Hosts not matching HOST_SELECTOR produce no metrics at all
+		if endpoint == "hosts" && !matchesSelector(hostSelector, x.Labels) {
+			skipped["selector"]++
+			e.counterVecs["objectsFiltered"].WithLabelValues(endpoint, "HOST_SELECTOR").Inc()
 			continue
 		}
 
-		log.Debug("Processing metrics for %s", endpoint)
+		if hidden {
+			skipped["system"]++
+		}
+
+		if endpoint == "projects" {
+
+			// Used to create a map of environment ID and name
+			// Later used as a dimension in host, stack and service metrics
+			e.storeEnvRef(x.ID, x.Name)
+
+			// Environments sharing a display name are told apart by their ID, rather than merging their metrics
+			// A collision is only counted and logged when first found, not on every scrape for as long as it persists
+			if firstID, ok := envNames[x.Name]; ok && firstID != x.ID {
+				if pair := [2]string{firstID, x.ID}; !e.envCollisions[pair] {
+					e.envCollisions[pair] = true
+					log.Warnf("Environments %s and %s share the name %q, labelling them with their IDs", firstID, x.ID, x.Name)
+					e.counterVecs["envNameCollisions"].WithLabelValues().Inc()
+				}
+				e.storeEnvRef(firstID, x.Name+" ("+firstID+")")
+				e.storeEnvRef(x.ID, x.Name+" ("+x.ID+")")
+			} else {
+				envNames[x.Name] = x.ID
+			}
 
-		if endpoint == "hosts" {
+		} else if endpoint == "hosts" {
 			var s = x.HostName
 			if x.Name != "" {
 				s = x.Name
 			}
-			if err := e.setHostMetrics(s, x.State, x.AgentState); err != nil {
-				log.Errorf("Error processing host metrics: %s", err)
-				log.Errorf("Attempt Failed to set %s, %s, [agent] %s ", x.HostName, x.State, x.AgentState)
 
-				continue
+			// Used to create a map of hostID and host name
+			// Later used as a dimension in container metrics
+			e.storeHostRef(x.ID, s)
+			objectStates[x.State]++
+
+			if !hidden {
+				// Hosts belong to the environment identified by their accountId
+				var envName = e.retrieveEnvRef(x.AccountID)
+				if envName == unknownEnvironment {
+					log.Warnf("Failed to obtain environment name for host %s from the API", s)
+					e.counterVecs["hostEnvironmentMisses"].WithLabelValues().Inc()
+				}
+
+				if err := e.setHostMetrics(s, envName, x.State, x.AgentState); err != nil {
+					log.Errorf("Error processing host metrics: %s", err)
+					log.Errorf("Attempt Failed to set %s, %s, [agent] %s ", x.HostName, x.State, x.AgentState)
+					if onUnknownState == "fail" {
+						return err
+					}
+					skipped["error"]++
+					continue
+				}
+				e.gaugeVecs["hostInfo"].WithLabelValues(s, envName, x.ID).Set(1)
+				expectedSeries++
+			}
+
+			hostsByAgentState[x.AgentState]++
+
+			// Counts hosts seen moving into reconnecting since the previous scrape, surfacing flapping agents
+			seen[x.ID] = true
+			if prev, ok := e.hostAgentStates[x.ID]; ok && prev != "reconnecting" && x.AgentState == "reconnecting" && !hidden {
+				e.counterVecs["hostReconnects"].WithLabelValues(s).Inc()
+			}
+			e.hostAgentStates[x.ID] = x.AgentState
+
+			// Only allowlisted label keys are aggregated, bounding the cardinality
+			for _, k := range hostLabelKeys {
+				if v, ok := x.Labels[k]; ok {
+					hostsByLabel[[2]string{k, v}]++
+				}
 			}
 
 		} else if endpoint == "stacks" {
 
 			// Used to create a map of stackID and stackName
 			// Later used as a dimension in service metrics
-			stackRef = storeStackRef(x.ID, x.Name)
+			e.storeStackRef(x.AccountID, x.ID, x.Name)
 
-			if err := e.setStackMetrics(x.Name, x.State, x.HealthState, strconv.FormatBool(x.System)); err != nil {
-				log.Errorf("Error processing stack metrics: %s", err)
-				log.Errorf("Attempt Failed to set %s, %s, %s, %t", x.Name, x.State, x.HealthState, x.System)
+			// Stacks filtered out produce no metrics at all, stored first so their services can be filtered with them
+			if rule := stackFilter.rejects(x.Name); rule != "" {
+				skipped["filter"]++
+				e.counterVecs["objectsFiltered"].WithLabelValues(endpoint, rule).Inc()
 				continue
 			}
+			objectStates[x.State]++
+
+			// Stacks left transitioning for too long are counted as stuck
+			seen[x.ID] = true
+			if e.trackTransition(x.ID, x.State, now) > e.stuckThreshold {
+				stacksStuck[x.State]++
+			}
+
+			if !hidden {
+				if err := e.setStackMetrics(x.Name, e.retrieveEnvRef(x.AccountID), x.State, x.HealthState, strconv.FormatBool(x.System)); err != nil {
+					log.Errorf("Error processing stack metrics: %s", err)
+					log.Errorf("Attempt Failed to set %s, %s, %s, %t", x.Name, x.State, x.HealthState, x.System)
+					if onUnknownState == "fail" {
+						return err
+					}
+					skipped["error"]++
+					continue
+				}
+				e.gaugeVecs["stackInfo"].WithLabelValues(x.Name, e.retrieveEnvRef(x.AccountID), x.ID).Set(1)
+				expectedSeries++
+			}
 
 		} else if endpoint == "services" {
 
+			// Used to create a map of serviceID and service name
+			// Later used as a dimension in container metrics
+			e.storeServiceRef(x.ID, x.Name)
+
 			// Retrieves the stack Name from the previous values stored.
-			var stackName = retrieveStackRef(x.StackID)
+			var stackName = e.retrieveStackRef(x.AccountID, x.StackID)
 
-			if stackName == "unknown" {
+			if stackName == unknownStack {
 				log.Warnf("Failed to obtain stack_name for %s from the API", x.Name)
 			}
 
-			if err := e.setServiceMetrics(x.Name, stackName, x.State, x.HealthState, x.Scale); err != nil {
-				log.Errorf("Error processing service metrics: %s", err)
-				log.Errorf("Attempt Failed to set %s, %s, %s, %s, %d", x.Name, stackName, x.State, x.HealthState, x.Scale)
+			// Services filtered out, or in a stack that is, produce no metrics at all
+			rule := serviceFilter.rejects(x.Name)
+			if rule == "" && stackName != unknownStack {
+				rule = stackFilter.rejects(stackName)
+			}
+			if rule != "" {
+				skipped["filter"]++
+				e.counterVecs["objectsFiltered"].WithLabelValues(endpoint, rule).Inc()
+				continue
+			}
+			objectStates[x.State]++
+
+			envName := e.retrieveEnvRef(x.AccountID)
+
+			if !hidden {
+				if err := e.setServiceMetrics(x.Name, stackName, envName, x.State, x.HealthState, x.Scale, x.CurrentScale); err != nil {
+					log.Errorf("Error processing service metrics: %s", err)
+					log.Errorf("Attempt Failed to set %s, %s, %s, %s, %d", x.Name, stackName, x.State, x.HealthState, x.Scale)
+					if onUnknownState == "fail" {
+						return err
+					}
+					skipped["error"]++
+					continue
+				}
+				e.gaugeVecs["serviceInfo"].WithLabelValues(x.Name, stackName, envName, x.ID).Set(1)
+				expectedSeries++
+			}
+
+			// Flags services whose state and health disagree, e.g. active but unhealthy
+			if !hidden && mismatchRules[x.State+":"+x.HealthState] {
+				e.gaugeVecs["serviceMismatch"].WithLabelValues(x.Name, stackName, envName).Set(1)
+				expectedSeries++
+			}
+
+			// Keyed by environment too, so same-named stacks in different environments aren't summed
+			stackServiceHealth[[3]string{stackName, envName, x.HealthState}]++
+
+			desiredScale += x.Scale
+			runningScale += x.CurrentScale
+
+			if image := serviceImage(x.LaunchConfig.ImageUUID); image != "" {
+				images[image] = true
+			}
+
+			// A service publishing a port on several hosts still counts once towards that port
+			ports := make(map[int]bool)
+			for _, p := range x.PublicEndpoints {
+				if p.Port > 0 && !ports[p.Port] {
+					ports[p.Port] = true
+					publishedPorts[p.Port]++
+				}
+			}
+
+			// Only services mid-transition are actively scaling, others are simply under or over scaled
+			if isTransitioning(x.State) {
+				if x.CurrentScale < x.Scale {
+					servicesScaling["up"]++
+				} else if x.CurrentScale > x.Scale {
+					servicesScaling["down"]++
+				}
+			}
+
+			// External services point outside of Rancher, track them separately for auditing
+			if x.Type == "externalService" {
+				externalServices++
+				if !hidden {
+					e.setExternalServiceMetrics(x.Name, stackName, envName, x.HostName, x.ExternalIPs)
+					expectedSeries++
+				}
+			}
+		} else if endpoint == "containers" {
+
+			// Containers belong to their primary service, sidekicks being listed after it
+			var serviceName = unknownService
+			if len(x.ServiceIDs) > 0 {
+				serviceName = e.retrieveServiceRef(x.ServiceIDs[0])
+			}
+
+			var stackName = e.retrieveStackRef(x.AccountID, x.StackID)
+
+			// Containers of a service or stack filtered out produce no metrics either
+			var rule string
+			if serviceName != unknownService {
+				rule = serviceFilter.rejects(serviceName)
+			}
+			if rule == "" && stackName != unknownStack {
+				rule = stackFilter.rejects(stackName)
+			}
+			if rule != "" {
+				skipped["filter"]++
+				e.counterVecs["objectsFiltered"].WithLabelValues(endpoint, rule).Inc()
+				continue
+			}
+
+			if !hidden {
+				e.setContainerMetrics(x.Name, serviceName, stackName, e.retrieveEnvRef(x.AccountID), e.retrieveHostRef(x.HostID), x.State, x.HealthState, x.StartCount)
+			}
+		} else if endpoint == "certificates" {
+
+			// Removed certificates linger in the API for a while, but are no longer served
+			if x.State == "removed" {
+				skipped["removed"]++
+				continue
+			}
+
+			expiry, err := time.Parse(time.RFC3339, x.ExpiresAt)
+			if err != nil {
+				log.Warnf("Unable to parse the expiry %q of certificate %s: %s", x.ExpiresAt, x.Name, err)
+				skipped["error"]++
 				continue
 			}
+			e.gaugeVecs["certificateExpiry"].WithLabelValues(x.Name, x.CN, e.retrieveEnvRef(x.AccountID)).Set(float64(expiry.Unix()))
+		}
 
-			e.setServiceMetrics(x.Name, stackName, x.State, x.HealthState, x.Scale)
+		if !hidden {
+			expectedSeries += seriesPerObject(endpoint)
 		}
+	}
 
+	// Objects by state, from the same objects as the metrics above, for the StatsD sink
+	if endpoint == "hosts" || endpoint == "stacks" || endpoint == "services" {
+		e.objectStates[endpoint] = objectStates
+	}
+
+	e.gaugeVecs["expectedSeries"].WithLabelValues(endpoint).Set(float64(expectedSeries))
+	for reason, count := range skipped {
+		e.gaugeVecs["objectsSkipped"].WithLabelValues(endpoint, reason).Set(float64(count))
+	}
+
+	if endpoint == "hosts" {
+		// Previous agent states are dropped for hosts that have since been removed
+		for id := range e.hostAgentStates {
+			if !seen[id] {
+				delete(e.hostAgentStates, id)
+			}
+		}
+
+		// Known states are emitted as zero when requested, so absent states still have a series
+		if e.emitZero {
+			for _, y := range agentStates {
+				if _, ok := hostsByAgentState[y]; !ok {
+					hostsByAgentState[y] = 0
+				}
+			}
+		}
+		for state, count := range hostsByAgentState {
+			e.setCount(endpoint, "hostsByAgentState", float64(count), state)
+		}
+		for label, count := range hostsByLabel {
+			e.setCount(endpoint, "hostsByLabel", float64(count), label[0], label[1])
+		}
+	}
+
+	if endpoint == "stacks" {
+		// Timers are dropped for stacks that have since been removed
+		for id := range e.transitions {
+			if !seen[id] {
+				delete(e.transitions, id)
+			}
+		}
+		if e.emitZero {
+			for _, y := range transitStates {
+				if _, ok := stacksStuck[y]; !ok {
+					stacksStuck[y] = 0
+				}
+			}
+		}
+		for state, count := range stacksStuck {
+			e.setCount(endpoint, "stacksStuck", float64(count), state)
+		}
+	}
+
+	if endpoint == "services" {
+		e.setCount(endpoint, "externalServicesCount", float64(externalServices))
+		e.setCount(endpoint, "distinctImages", float64(len(images)))
+		for direction, count := range servicesScaling {
+			e.setCount(endpoint, "servicesScaling", float64(count), direction)
+		}
+		// Every stored stack gets each health state when zeros are wanted, including stacks without services.
+		// Stacks left out by the stack filter are stored too, so their services can be filtered, but emit nothing
+		if e.emitZero {
+			e.refMutex.RLock()
+			stacks := make(map[string]string, len(e.stackRef))
+			for key, stack := range e.stackRef {
+				stacks[key] = stack
+			}
+			e.refMutex.RUnlock()
+
+			for key, stack := range stacks {
+				if stackFilter.rejects(stack) != "" {
+					continue
+				}
+				// Stacks are stored under envID/stackID
+				env := e.retrieveEnvRef(strings.SplitN(key, "/", 2)[0])
+				for _, y := range healthStates {
+					if _, ok := stackServiceHealth[[3]string{stack, env, y}]; !ok {
+						stackServiceHealth[[3]string{stack, env, y}] = 0
+					}
+				}
+			}
+		}
+		for pivot, count := range stackServiceHealth {
+			e.setCount(endpoint, "stackServiceHealth", float64(count), pivot[0], pivot[1], pivot[2])
+		}
+		for port, count := range publishedPorts {
+			e.setCount(endpoint, "publishedPorts", float64(count), strconv.Itoa(port))
+		}
+
+		// With nothing desired the cluster is trivially meeting its desired capacity
+		fulfillment := 1.0
+		if desiredScale > 0 {
+			fulfillment = float64(runningScale) / float64(desiredScale)
+		}
+		e.setCount(endpoint, "clusterScaleFulfillment", fulfillment)
 	}
 
 	return nil
 }
 
 // gatherData - Collects the data from thw API, invokes functions to transform that data into metrics
-func (e *Exporter) gatherData(rancherURL string, accessKey string, secretKey string, endpoint string, ch chan<- prometheus.Metric) (*Data, error) {
+func (e *Exporter) gatherData(ctx context.Context, rancherURL string, accessKey string, secretKey string, endpoint string, ch chan<- prometheus.Metric) (*Data, error) {
 
 	// Return the correct URL path
-	url := setEndpoint(rancherURL, endpoint)
+	url := withPageSize(setEndpoint(rancherURL, e.environmentID, endpoint))
 
-	// Create new data slice from Struct
-	var data = new(Data)
+	return e.gatherURL(ctx, url, endpoint, accessKey, secretKey)
+}
+
+// gatherURL - Collects every page of an endpoint's data from the URL
+func (e *Exporter) gatherURL(ctx context.Context, url string, endpoint string, accessKey string, secretKey string) (*Data, error) {
 
 	// Scrape EndPoint for JSON Data
-	err := getJSON(url, accessKey, secretKey, &data)
+	data, err := e.getPage(ctx, url, endpoint, accessKey, secretKey)
 	if err != nil {
 		log.Error("Error getting JSON from endpoint ", endpoint)
 		return nil, err
 	}
+
+	// Follow the pagination cursor, appending each further page, up to MAX_PAGES
+	pages := 1
+	truncated := false
+	for data.Pagination.Next != "" {
+		if pages >= maxPages {
+			log.Warnf("Endpoint %s has more than MAX_PAGES (%d) pages, the remaining pages have not been gathered", endpoint, maxPages)
+			truncated = true
+			break
+		}
+
+		page, err := e.getPage(ctx, data.Pagination.Next, endpoint, accessKey, secretKey)
+		if err != nil {
+			log.Errorf("Error getting page %d of JSON from endpoint %s", pages+1, endpoint)
+			return nil, err
+		}
+		data.Data = append(data.Data, page.Data...)
+		data.Pagination = page.Pagination
+		pages++
+	}
 	log.Debugf("JSON Fetched for: "+endpoint+": ", data)
 
+	// Flag whether the endpoint spanned more than one page, including when MAX_PAGES left further pages ungathered
+	if pages > 1 || truncated {
+		e.gaugeVecs["endpointPaginated"].WithLabelValues(endpoint).Set(1)
+	} else {
+		e.gaugeVecs["endpointPaginated"].WithLabelValues(endpoint).Set(0)
+	}
+
+	// Flag whether MAX_PAGES stopped pagination before the API was done, leaving the metrics incomplete
+	if truncated {
+		e.gaugeVecs["paginationTruncated"].WithLabelValues(endpoint).Set(1)
+	} else {
+		e.gaugeVecs["paginationTruncated"].WithLabelValues(endpoint).Set(0)
+	}
+
+	return data, nil
+}
+
+// getPage - Requests and decodes a single page of an endpoint, keeping the raw objects when fields are remapped
+func (e *Exporter) getPage(ctx context.Context, url string, endpoint string, accessKey string, secretKey string) (*Data, error) {
+
+	// Create new data slice from Struct
+	var data = new(Data)
+
+	var err error
+	if len(fieldMap) > 0 {
+		var raw json.RawMessage
+		if err = e.getJSON(ctx, url, endpoint, accessKey, secretKey, &raw); err == nil {
+			// The response is only decoded into the objects here, counted as getJSON counts its own decode errors
+			if err = decodeMapped(raw, data); err != nil {
+				log.Errorf("Error decoding JSON from %s: %s", endpoint, err)
+				e.counterVecs["decodeErrors"].WithLabelValues(endpoint).Inc()
+			}
+		}
+	} else {
+		err = e.getJSON(ctx, url, endpoint, accessKey, secretKey, &data)
+	}
 	return data, err
 }
 
-// getJSON return json from server, return the formatted JSON
-func getJSON(url string, accessKey string, secretKey string, target interface{}) error {
+// getJSON return json from server, return the formatted JSON. The request is abandoned once ctx is done
+func (e *Exporter) getJSON(ctx context.Context, url string, endpoint string, accessKey string, secretKey string, target interface{}) error {
 
 	start := time.Now()
 
 	// Counter for internal exporter metrics
 	measure.FunctionCountTotal.With(prometheus.Labels{"pkg": "main", "fnc": "getJSON"}).Inc()
+	e.statsMutex.Lock()
+	e.apiCalls++
+	e.statsMutex.Unlock()
 
-	log.Info("Scraping: ", url)
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
+	log.Debug("Scraping: ", url)
 
-	client := &http.Client{Transport: tr}
 	req, err := http.NewRequest("GET", url, nil)
 
 	if err != nil {
 		log.Error("Error Collecting JSON from API: ", err)
+		return err
 	}
 
+	req = req.WithContext(ctx)
 	req.SetBasicAuth(accessKey, secretKey)
-	resp, err := client.Do(req)
+	resp, err := e.doWithRetry(req)
 
 	if err != nil {
 		log.Error("Error Collecting JSON from API: ", err)
+		return err
 	}
 
-	if ! strings.Contains(resp.Status, "200") {
-		log.Error("Error returned from API: ",resp.Status) 	
-	}	
-	
-	respFormatted := json.NewDecoder(resp.Body).Decode(target)
+	// Close the response body, the underlying Transport should then close the connection.
+	defer resp.Body.Close()
+
+	// Track the server version and schema advertised by the API
+	e.observeAPIVersion(resp.Header.Get("X-Rancher-Version"), resp.Header.Get("X-Api-Schemas"))
+
+	// Error bodies, e.g. from expired credentials, are not decoded as data
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Error("Error returned from API: ", resp.Status)
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+
+	// Bound how much of the (decompressed) body is read, protecting against pathological responses
+	body := &io.LimitedReader{R: resp.Body, N: maxResponseBytes}
+	respFormatted := json.NewDecoder(body).Decode(target)
+	if respFormatted != nil && body.N <= 0 {
+		respFormatted = fmt.Errorf("response from %s exceeded the %d byte limit", endpoint, maxResponseBytes)
+		log.Error(respFormatted)
+		e.counterVecs["responseLimitExceeded"].WithLabelValues(endpoint).Inc()
+	} else if respFormatted != nil {
+		log.Errorf("Error decoding JSON from %s: %s", endpoint, respFormatted)
+		e.counterVecs["decodeErrors"].WithLabelValues(endpoint).Inc()
+	}
 
 	// Timings recorded as part of internal metrics
 	elapsed := float64((time.Since(start)) / time.Microsecond)
 	measure.FunctionDurations.WithLabelValues("main", "getJSON").Observe(elapsed)
-
-	// Close the response body, the underlying Transport should then close the connection.
-	resp.Body.Close()
+	e.observeResponseTime(endpoint, time.Since(start).Seconds())
 
 	// return formatted JSON
 	return respFormatted
 }
 
+// transient - Whether the error of a request may go away on a retry, i.e. a timeout or a refused or reset connection.
+// Other errors, such as a certificate failing verification, fail the same way on every attempt.
+func transient(err error) bool {
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// doWithRetry - Sends the request, retrying transient failures (timeouts, refused or reset connections and 5xx
+// responses) with an exponential backoff. The last attempt's response or error is returned as is, as is the
+// response or error of any attempt once the request's context is done.
+func (e *Exporter) doWithRetry(req *http.Request) (*http.Response, error) {
+
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := e.client.Do(req)
+		if attempt >= maxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if (err == nil && resp.StatusCode < 500) || (err != nil && !transient(err)) {
+			return resp, err
+		}
+
+		if err != nil {
+			log.Warnf("Attempt %d of %d to %s failed: %s", attempt, maxAttempts, req.URL, err)
+		} else {
+			log.Warnf("Attempt %d of %d to %s returned %s", attempt, maxAttempts, req.URL, resp.Status)
+			resp.Body.Close()
+		}
+		measure.FunctionRetriesTotal.WithLabelValues("main", "getJSON").Inc()
+		e.statsMutex.Lock()
+		e.retries++
+		e.statsMutex.Unlock()
+
+		// Retries stop once the scrape deadline has passed
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// newClient - Returns the HTTP client used to talk to the Rancher API, built once so its connections are reused across scrapes
+func (e *Exporter) newClient() *http.Client {
+
+	// A custom TLSClientConfig disables HTTP/2 unless explicitly attempted. Each transport
+	// gets its own copy, as enabling HTTP/2 modifies the config's NextProtos
+	tr := &http.Transport{
+		TLSClientConfig:   e.tlsConfig.Clone(),
+		ForceAttemptHTTP2: !disableHTTP2,
+	}
+	if disableHTTP2 {
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	// HTTP is sent over the unix socket when one is configured, whatever the request host
+	if e.socketPath != "" {
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", e.socketPath)
+		}
+	}
+
+	// The timeout covers the whole request, including reading the body
+	return &http.Client{Transport: tr, Timeout: scrapeTimeout}
+}
+
+// probe - Lightweight check the Rancher API is reachable, requesting the API root without decoding any objects
+func (e *Exporter) probe() error {
+
+	url := strings.Replace(e.rancherURL, "v1", "v2-beta", 1)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(e.accessKey, e.secretKey)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("API root returned %s", resp.Status)
+	}
+
+	e.history.markFetched()
+	return nil
+}
+
+// serverHealthy - Requests Rancher's own health check, relative to the server root, reporting whether it answered with a 2xx.
+// The request is abandoned once ctx, the scrape's deadline, is done
+func (e *Exporter) serverHealthy(ctx context.Context) bool {
+
+	u, err := url.Parse(e.rancherURL)
+	if err != nil {
+		log.Errorf("Unable to parse Rancher URL for the server health check: %s", err)
+		return false
+	}
+	u.Path = serverHealthPath
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		log.Errorf("Error requesting Rancher server health: %s", err)
+		return false
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(e.accessKey, e.secretKey)
+
+	e.statsMutex.Lock()
+	e.apiCalls++
+	e.statsMutex.Unlock()
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Errorf("Error requesting Rancher server health: %s", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Warnf("Rancher server health check %s returned %s", serverHealthPath, resp.Status)
+		return false
+	}
+	return true
+}
+
+// observeResponseTime - Folds the response time into the endpoint's exponentially weighted moving average,
+// the first response seeding the average
+func (e *Exporter) observeResponseTime(endpoint string, seconds float64) {
+
+	e.statsMutex.Lock()
+	defer e.statsMutex.Unlock()
+
+	avg, ok := e.avgResponse[endpoint]
+	if ok {
+		avg = responseAlpha*seconds + (1-responseAlpha)*avg
+	} else {
+		avg = seconds
+	}
+	e.avgResponse[endpoint] = avg
+
+	e.gaugeVecs["apiAvgResponse"].WithLabelValues(endpoint).Set(avg)
+}
+
+// observeAPIVersion - Records the server version and API schema version reported by the scrape, from the first
+// response carrying them. The schemas URL itself differs with the scope of each request, only the API version it
+// is served under is kept.
+func (e *Exporter) observeAPIVersion(version string, schemas string) {
+
+	if version == "" && schemas == "" {
+		return
+	}
+
+	e.statsMutex.Lock()
+	defer e.statsMutex.Unlock()
+
+	if e.scrapeVersion == nil {
+		e.scrapeVersion = &apiVersion{version: version, schema: schemaVersion(schemas)}
+	}
+}
+
+// compareAPIVersion - Sets the server version info metric from the scrape, counting any change in version or schema
+// since the previous scrape reporting them
+func (e *Exporter) compareAPIVersion() {
+
+	e.statsMutex.Lock()
+	current := e.scrapeVersion
+	e.statsMutex.Unlock()
+
+	if current == nil {
+		return
+	}
+	e.gaugeVecs["serverVersion"].With(prometheus.Labels{"version": current.version, "schema": current.schema}).Set(1)
+
+	if e.apiVersion != nil && *e.apiVersion != *current {
+		log.Warnf("Rancher API version changed from %s to %s, metric mappings may need review", e.apiVersion, current)
+		e.counterVecs["apiSchemaChanged"].With(prometheus.Labels{}).Inc()
+	}
+	e.apiVersion = current
+}
+
+// schemaVersion - Returns the API version the schemas are served under, the first element of the schemas URL's path,
+// e.g. v2-beta from http://rancher/v2-beta/projects/1a5/schemas
+func schemaVersion(schemas string) string {
+
+	u, err := url.Parse(schemas)
+	if err != nil {
+		return schemas
+	}
+	return strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+}
+
+// serviceImage - Returns the image reference from a launch config imageUuid, stripping the `docker:` scheme
+func serviceImage(imageUUID string) string {
+
+	return strings.TrimPrefix(imageUUID, "docker:")
+}
+
+// unixSocketURL - Splits a unix:// Rancher URL into the socket path, and the base URL used for HTTP over that socket,
+// the path of the API selected by API_VERSION
+func unixSocketURL(rancherURL string) (string, string) {
+
+	if !strings.HasPrefix(rancherURL, "unix://") {
+		return "", rancherURL
+	}
+
+	return strings.TrimPrefix(rancherURL, "unix://"), "http://unix/" + apiMode
+}
+
 // setEndpoint - Determines the correct URL endpoint to use, gives us backwards compatibility
-func setEndpoint(rancherURL string, component string) string {
+// When an environment ID is supplied the project-nested path is used, e.g. /projects/1a5/services/
+func setEndpoint(rancherURL string, environmentID string, component string) string {
 
 	var endpoint string
 
-	endpoint = (rancherURL + "/" + component + "/")
-    endpoint = strings.Replace(endpoint, "v1", "v2-beta", 1)
+	// The v3 API is used as given, its collections aren't nested under an environment
+	if apiMode == "v3" {
+		return rancherURL + "/" + component
+	}
+
+	if environmentID != "" && component != "projects" {
+		endpoint = (rancherURL + "/projects/" + environmentID + "/" + component + "/")
+	} else {
+		endpoint = (rancherURL + "/" + component + "/")
+	}
+	endpoint = strings.Replace(endpoint, "v1", "v2-beta", 1)
 
 	return endpoint
 }
 
-// storeStackRef stores the stackID and stack name for use as a label elsewhere
-func storeStackRef(stackID string, stackName string) map[string]string {
+// withPageSize - Requests PAGE_SIZE objects per page, when set. Later pages follow the cursor, which carries the limit
+func withPageSize(endpoint string) string {
+
+	if pageSize == 0 {
+		return endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	q := u.Query()
+	q.Set("limit", strconv.Itoa(pageSize))
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// storeStackRef stores the stackID and stack name for use as a label elsewhere, keyed by environment so reused IDs don't collide
+func (e *Exporter) storeStackRef(envID string, stackID string, stackName string) {
 
-	stackRef[stackID] = stackName
+	e.refMutex.Lock()
+	defer e.refMutex.Unlock()
 
-	return stackRef
+	e.stackRef[envID+"/"+stackID] = stackName
 }
 
-// retrieveStackRef returns the stack name, when sending the stackID
-func retrieveStackRef(stackID string) string {
+// storeServiceRef stores the serviceID and service name for use as a label elsewhere
+func (e *Exporter) storeServiceRef(serviceID string, serviceName string) {
 
-	for key, value := range stackRef {
-		if stackID == "" {
-			return "unknown"
-		} else if stackID == key {
-			log.Debugf("StackRef - Key is %s, Value is %s StackID is %s", key, value, stackID)
-			return value
-		}
+	e.refMutex.Lock()
+	defer e.refMutex.Unlock()
+
+	e.serviceRef[serviceID] = serviceName
+}
+
+// storeHostRef stores the hostID and host name for use as a label elsewhere
+func (e *Exporter) storeHostRef(hostID string, hostName string) {
+
+	e.refMutex.Lock()
+	defer e.refMutex.Unlock()
+
+	e.hostRef[hostID] = hostName
+}
+
+// resetRefs clears the stored environments, stacks, services and hosts, so objects deleted in Rancher don't linger between scrapes
+func (e *Exporter) resetRefs() {
+
+	e.refMutex.Lock()
+	defer e.refMutex.Unlock()
+
+	e.envRef = make(map[string]string)
+	e.stackRef = make(map[string]string)
+	e.serviceRef = make(map[string]string)
+	e.hostRef = make(map[string]string)
+}
+
+// storeEnvRef stores the environment ID and environment name for use as a label elsewhere
+func (e *Exporter) storeEnvRef(envID string, envName string) {
+
+	e.refMutex.Lock()
+	defer e.refMutex.Unlock()
+
+	e.envRef[envID] = envName
+}
+
+// retrieveEnvRef returns the environment name, when sending the environment ID
+func (e *Exporter) retrieveEnvRef(envID string) string {
+
+	e.refMutex.RLock()
+	defer e.refMutex.RUnlock()
+
+	if value, ok := e.envRef[envID]; ok && envID != "" {
+		return value
+	}
+
+	// returns unknown if no match was found
+	return unknownEnvironment
+}
+
+// retrieveStackRef returns the stack name, when sending the environment and stackID
+func (e *Exporter) retrieveStackRef(envID string, stackID string) string {
+
+	// services outside of a stack have no stackID to resolve
+	if stackID == "" {
+		return unknownStack
+	}
+
+	e.refMutex.RLock()
+	defer e.refMutex.RUnlock()
+
+	if value, ok := e.stackRef[envID+"/"+stackID]; ok {
+		return value
 	}
+
+	// returns unknown if no match was found
+	return unknownStack
+}
+
+// retrieveServiceRef returns the service name, when sending the serviceID
+func (e *Exporter) retrieveServiceRef(serviceID string) string {
+
+	e.refMutex.RLock()
+	defer e.refMutex.RUnlock()
+
+	if value, ok := e.serviceRef[serviceID]; ok && serviceID != "" {
+		return value
+	}
+
+	// returns unknown if no match was found
+	return unknownService
+}
+
+// retrieveHostRef returns the host name, when sending the hostID
+func (e *Exporter) retrieveHostRef(hostID string) string {
+
+	e.refMutex.RLock()
+	defer e.refMutex.RUnlock()
+
+	if value, ok := e.hostRef[hostID]; ok && hostID != "" {
+		return value
+	}
+
 	// returns unknown if no match was found
-	return "unknown"
+	return unknownHost
 }
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestServer - Serves the canned body of each collection, matched on the last element of the path, and an empty
+// collection for everything else
+func newTestServer(bodies map[string]string) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		collection := path[strings.LastIndex(path, "/")+1:]
+		if body, ok := bodies[collection]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		w.Write([]byte(`{"data":[]}`))
+	}))
+}
+
+// newTestExporter - Creates an exporter against the Rancher URL, with system services hidden
+func newTestExporter(rancherURL string) *Exporter {
+
+	return newExporter(rancherURL, "", "", &tls.Config{}, "", true, false, false, false, 5, 5, 10*time.Minute)
+}
+
+// gatherFamilies - Registers the collectors with a fresh registry, returning the gathered metric families by name
+func gatherFamilies(t testing.TB, cs ...prometheus.Collector) map[string]*dto.MetricFamily {
+
+	reg := prometheus.NewPedanticRegistry()
+	for _, c := range cs {
+		if err := reg.Register(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	return families
+}
+
+// gaugeValue - Returns the value of the family's gauge carrying every name value pair of the labels, or -1 when there
+// is none
+func gaugeValue(mf *dto.MetricFamily, labels ...string) float64 {
+
+	if mf == nil {
+		return -1
+	}
+	for _, m := range mf.GetMetric() {
+		values := make(map[string]string)
+		for _, l := range m.GetLabel() {
+			values[l.GetName()] = l.GetValue()
+		}
+		matched := true
+		for i := 0; i+1 < len(labels); i += 2 {
+			if v, ok := values[labels[i]]; !ok || v != labels[i+1] {
+				matched = false
+			}
+		}
+		if matched {
+			return m.GetGauge().GetValue()
+		}
+	}
+	return -1
+}
+
+// decodeData - Decodes the body of a collection
+func decodeData(t testing.TB, body string) *Data {
+
+	data := new(Data)
+	if err := json.Unmarshal([]byte(body), data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// benchmarkData - Decodes a collection of n stacks, or n services spread across n/10 stacks
+func benchmarkData(b *testing.B, endpoint string, n int) *Data {
+
+	objects := make([]string, n)
+	for i := range objects {
+		if endpoint == "stacks" {
+			objects[i] = fmt.Sprintf(`{"id":"1st%d","name":"stack-%d","type":"stack","accountId":"1a5","state":"active","healthState":"healthy"}`, i, i)
+		} else {
+			objects[i] = fmt.Sprintf(`{"id":"1s%d","name":"service-%d","type":"service","accountId":"1a5","stackId":"1st%d","state":"active","healthState":"healthy","scale":2,"currentScale":2,"launchConfig":{"imageUuid":"docker:nginx:%d"}}`, i, i, i%(n/10), i%50)
+		}
+	}
+
+	return decodeData(b, `{"data":[`+strings.Join(objects, ",")+`]}`)
+}
+
+// TestRetrieveStackRef - Stack names resolve for stored stacks only, within the environment they were stored for
+func TestRetrieveStackRef(t *testing.T) {
+
+	e := newTestExporter("http://rancher/v2-beta")
+	e.storeStackRef("1a5", "1st5", "web")
+
+	tests := []struct {
+		name    string
+		envID   string
+		stackID string
+		want    string
+	}{
+		{"empty stackID", "1a5", "", unknownStack},
+		{"known stackID", "1a5", "1st5", "web"},
+		{"unknown stackID", "1a5", "1st6", unknownStack},
+		{"stackID of another environment", "1a7", "1st5", unknownStack},
+	}
+
+	for _, tt := range tests {
+		if got := e.retrieveStackRef(tt.envID, tt.stackID); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestSetEndpoint - Collections are nested under the environment when one is set, except the projects themselves
+func TestSetEndpoint(t *testing.T) {
+
+	tests := []struct {
+		rancherURL    string
+		environmentID string
+		component     string
+		want          string
+	}{
+		{"http://rancher/v2-beta", "", "services", "http://rancher/v2-beta/services/"},
+		{"http://rancher/v2-beta", "1a5", "services", "http://rancher/v2-beta/projects/1a5/services/"},
+		{"http://rancher/v2-beta", "1a5", "projects", "http://rancher/v2-beta/projects/"},
+		{"http://rancher/v1", "", "hosts", "http://rancher/v2-beta/hosts/"},
+		{"http://rancher/v1", "1a5", "hosts", "http://rancher/v2-beta/projects/1a5/hosts/"},
+	}
+
+	for _, tt := range tests {
+		if got := setEndpoint(tt.rancherURL, tt.environmentID, tt.component); got != tt.want {
+			t.Errorf("setEndpoint(%q, %q, %q) = %q, want %q", tt.rancherURL, tt.environmentID, tt.component, got, tt.want)
+		}
+	}
+}
+
+// TestNewClientHTTP2 - HTTP/2 is negotiated with the Rancher API over TLS, unless DISABLE_HTTP2 is set
+func TestNewClientHTTP2(t *testing.T) {
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	defer func(disabled bool) { disableHTTP2 = disabled }(disableHTTP2)
+
+	for _, tt := range []struct {
+		disabled bool
+		want     int
+	}{
+		{false, 2},
+		{true, 1},
+	} {
+		disableHTTP2 = tt.disabled
+		e := newTestExporter(srv.URL + "/v2-beta")
+		e.tlsConfig = &tls.Config{RootCAs: roots}
+		e.client = e.newClient()
+
+		resp, err := e.client.Get(srv.URL + "/v2-beta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != tt.want {
+			t.Errorf("disableHTTP2 %t: got %s, want HTTP/%d", tt.disabled, resp.Proto, tt.want)
+		}
+	}
+}
+
+// TestGetJSONErrorStatus - Error responses fail the request and the endpoint, without their body being decoded
+func TestGetJSONErrorStatus(t *testing.T) {
+
+	defer func(attempts int) { maxAttempts = attempts }(maxAttempts)
+	maxAttempts = 1
+
+	for _, status := range []int{http.StatusUnauthorized, http.StatusInternalServerError} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"data":[{"id":"1h1","hostname":"error","type":"host","state":"active"}]}`))
+		}))
+		e := newTestExporter(srv.URL + "/v2-beta")
+
+		data := new(Data)
+		if err := e.getJSON(context.Background(), srv.URL+"/v2-beta/hosts/", "hosts", "", "", data); err == nil {
+			t.Errorf("status %d: expected an error", status)
+		}
+		if len(data.Data) != 0 {
+			t.Errorf("status %d: expected nothing decoded, got %d objects", status, len(data.Data))
+		}
+
+		mfs := gatherFamilies(t, e)
+		if v := gaugeValue(mfs["rancher_exporter_endpoint_up"], "endpoint", "hosts"); v != 0 {
+			t.Errorf("status %d: expected rancher_exporter_endpoint_up 0, got %v", status, v)
+		}
+		srv.Close()
+	}
+}
+
+// TestContainerFilters - Containers of a stack or service filtered out produce no metrics, and are counted as filtered
+func TestContainerFilters(t *testing.T) {
+
+	defer func(stacks, services nameFilter) { stackFilter, serviceFilter = stacks, services }(stackFilter, serviceFilter)
+	var err error
+	if stackFilter, err = newNameFilter("STACK_FILTER", "", "STACK_EXCLUDE", "^ci-"); err != nil {
+		t.Fatal(err)
+	}
+	if serviceFilter, err = newNameFilter("SERVICE_FILTER", "", "SERVICE_EXCLUDE", "^debug$"); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTestExporter("http://rancher/v2-beta")
+	for _, c := range []struct {
+		endpoint string
+		body     string
+	}{
+		{"stacks", `{"data":[
+			{"id":"1st1","type":"stack","name":"web","accountId":"1a5","state":"active","healthState":"healthy"},
+			{"id":"1st2","type":"stack","name":"ci-123","accountId":"1a5","state":"active","healthState":"healthy"}]}`},
+		{"services", `{"data":[
+			{"id":"1s1","type":"service","name":"nginx","stackId":"1st1","accountId":"1a5","state":"active","healthState":"healthy"},
+			{"id":"1s2","type":"service","name":"debug","stackId":"1st1","accountId":"1a5","state":"active","healthState":"healthy"},
+			{"id":"1s3","type":"service","name":"runner","stackId":"1st2","accountId":"1a5","state":"active","healthState":"healthy"}]}`},
+		{"containers", `{"data":[
+			{"id":"1i1","type":"container","name":"web-nginx-1","serviceIds":["1s1"],"stackId":"1st1","accountId":"1a5","state":"running","healthState":"healthy"},
+			{"id":"1i2","type":"container","name":"web-debug-1","serviceIds":["1s2"],"stackId":"1st1","accountId":"1a5","state":"running","healthState":"healthy"},
+			{"id":"1i3","type":"container","name":"ci-123-runner-1","serviceIds":["1s3"],"stackId":"1st2","accountId":"1a5","state":"running","healthState":"healthy"}]}`},
+	} {
+		if err := e.processMetrics(decodeData(t, c.body), c.endpoint, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mfs := gatherFamilies(t, e.gaugeVecs["containerState"])
+	for name, want := range map[string]float64{"web-nginx-1": 1, "web-debug-1": -1, "ci-123-runner-1": -1} {
+		if v := gaugeValue(mfs["rancher_container_state"], "name", name); v != want {
+			t.Errorf("container %s: got %v, want %v", name, v, want)
+		}
+	}
+
+	for rule, want := range map[string]float64{"STACK_EXCLUDE": 1, "SERVICE_EXCLUDE": 1} {
+		if v := testutil.ToFloat64(e.counterVecs["objectsFiltered"].WithLabelValues("containers", rule)); v != want {
+			t.Errorf("containers filtered by %s: got %v, want %v", rule, v, want)
+		}
+	}
+}
+
+// TestDoWithRetry - Only transient failures are retried, and nothing is retried once the request's context is done
+func TestDoWithRetry(t *testing.T) {
+
+	defer func(attempts int, backoff time.Duration) { maxAttempts, retryBackoff = attempts, backoff }(maxAttempts, retryBackoff)
+	maxAttempts, retryBackoff = 3, time.Millisecond
+
+	var hits int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	untrusted := httptest.NewTLSServer(handler)
+	defer untrusted.Close()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, tt := range []struct {
+		name    string
+		ctx     context.Context
+		url     string
+		hits    int32
+		retries int
+	}{
+		{"5xx response", context.Background(), plain.URL, 3, 2},
+		{"certificate failing verification", context.Background(), untrusted.URL, 0, 0},
+		{"cancelled context", cancelled, plain.URL, 0, 0},
+	} {
+		atomic.StoreInt32(&hits, 0)
+		e := newTestExporter(tt.url + "/v2-beta")
+
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := e.doWithRetry(req.WithContext(tt.ctx)); err == nil {
+			resp.Body.Close()
+		}
+
+		if n := atomic.LoadInt32(&hits); n != tt.hits {
+			t.Errorf("%s: got %d requests, want %d", tt.name, n, tt.hits)
+		}
+		if e.retries != tt.retries {
+			t.Errorf("%s: got %d retries, want %d", tt.name, e.retries, tt.retries)
+		}
+	}
+}
+
+// TestFieldMapDecodeError - Responses failing to decode once their fields are remapped are counted as decode errors
+func TestFieldMapDecodeError(t *testing.T) {
+
+	defer func(m map[string]string) { fieldMap = m }(fieldMap)
+	fieldMap = map[string]string{"name": "displayName"}
+
+	srv := newTestServer(map[string]string{"services": `{"data":[{"id":"1s1","type":"service","displayName":"web","scale":"two"}]}`})
+	defer srv.Close()
+
+	e := newTestExporter(srv.URL + "/v2-beta")
+	mfs := gatherFamilies(t, e)
+
+	if v := gaugeValue(mfs["rancher_exporter_endpoint_up"], "endpoint", "services"); v != 0 {
+		t.Errorf("expected rancher_exporter_endpoint_up 0, got %v", v)
+	}
+	if v := testutil.ToFloat64(e.counterVecs["decodeErrors"].WithLabelValues("services")); v != 1 {
+		t.Errorf("expected 1 decode error, got %v", v)
+	}
+}
+
+// TestSameNamesAcrossEnvironments - Same-named stacks and services in different environments keep separate series
+func TestSameNamesAcrossEnvironments(t *testing.T) {
+
+	e := newTestExporter("http://rancher/v2-beta")
+	for _, c := range []struct {
+		endpoint string
+		body     string
+	}{
+		{"projects", `{"data":[
+			{"id":"1a5","name":"prod","type":"project","state":"active"},
+			{"id":"1a7","name":"staging","type":"project","state":"active"}]}`},
+		{"stacks", `{"data":[
+			{"id":"1st1","name":"web","type":"stack","accountId":"1a5","state":"active","healthState":"healthy"},
+			{"id":"1st2","name":"web","type":"stack","accountId":"1a7","state":"active","healthState":"healthy"}]}`},
+		{"services", `{"data":[
+			{"id":"1s1","name":"nginx","type":"service","stackId":"1st1","accountId":"1a5","state":"active","healthState":"healthy"},
+			{"id":"1s2","name":"nginx","type":"service","stackId":"1st2","accountId":"1a7","state":"active","healthState":"healthy"}]}`},
+	} {
+		if err := e.processMetrics(decodeData(t, c.body), c.endpoint, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mfs := gatherFamilies(t, e.gaugeVecs["stackInfo"], e.gaugeVecs["serviceInfo"], e.gaugeVecs["stackServiceHealth"])
+
+	for _, env := range []string{"prod", "staging"} {
+		if v := gaugeValue(mfs["rancher_stack_service_health"], "stack_name", "web", "environment_name", env, "health_state", "healthy"); v != 1 {
+			t.Errorf("%s: expected 1 healthy service in stack web, got %v", env, v)
+		}
+		if v := gaugeValue(mfs["rancher_stack_info"], "environment_name", env); v != 1 {
+			t.Errorf("%s: expected the stack info, got %v", env, v)
+		}
+		if v := gaugeValue(mfs["rancher_service_info"], "environment_name", env); v != 1 {
+			t.Errorf("%s: expected the service info, got %v", env, v)
+		}
+	}
+}
+
+// TestPagination - Pages are followed through pagination.next, up to MAX_PAGES, flagging an endpoint left truncated
+func TestPagination(t *testing.T) {
+
+	defer func(pages int) { maxPages = pages }(maxPages)
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := 1
+		fmt.Sscan(r.URL.Query().Get("page"), &page)
+
+		next := ""
+		if page < 3 {
+			next = fmt.Sprintf("%s/v2-beta/hosts/?page=%d", srv.URL, page+1)
+		}
+		fmt.Fprintf(w, `{"data":[{"id":"1h%d","hostname":"host-%d","type":"host","state":"active"}],"pagination":{"next":%q}}`, page, page, next)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		maxPages  int
+		hosts     int
+		truncated float64
+	}{
+		{100, 3, 0},
+		{3, 3, 0},
+		{2, 2, 1},
+	} {
+		maxPages = tt.maxPages
+		e := newTestExporter(srv.URL + "/v2-beta")
+
+		data, err := e.gatherData(context.Background(), e.rancherURL, "", "", "hosts", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Data) != tt.hosts {
+			t.Errorf("MAX_PAGES %d: got %d hosts, want %d", tt.maxPages, len(data.Data), tt.hosts)
+		}
+
+		mfs := gatherFamilies(t, e.gaugeVecs["endpointPaginated"], e.gaugeVecs["paginationTruncated"])
+		if v := gaugeValue(mfs["rancher_endpoint_paginated"], "endpoint", "hosts"); v != 1 {
+			t.Errorf("MAX_PAGES %d: got rancher_endpoint_paginated %v, want 1", tt.maxPages, v)
+		}
+		if v := gaugeValue(mfs["rancher_pagination_truncated"], "endpoint", "hosts"); v != tt.truncated {
+			t.Errorf("MAX_PAGES %d: got rancher_pagination_truncated %v, want %v", tt.maxPages, v, tt.truncated)
+		}
+	}
+}
+
+// TestEnvNameCollisionsCountedOnce - A collision persisting across scrapes is counted once, when first found
+func TestEnvNameCollisionsCountedOnce(t *testing.T) {
+
+	e := newTestExporter("http://rancher/v2-beta")
+	body := `{"data":[
+		{"id":"1a5","name":"prod","type":"project","state":"active"},
+		{"id":"1a7","name":"prod","type":"project","state":"active"}]}`
+
+	for scrape := 1; scrape <= 3; scrape++ {
+		if err := e.processMetrics(decodeData(t, body), "projects", false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if v := testutil.ToFloat64(e.counterVecs["envNameCollisions"].WithLabelValues()); v != 1 {
+			t.Errorf("scrape %d: got %v collisions, want 1", scrape, v)
+		}
+		if env := e.retrieveEnvRef("1a7"); env != "prod (1a7)" {
+			t.Errorf("scrape %d: got environment name %q, want %q", scrape, env, "prod (1a7)")
+		}
+	}
+}
+
+// TestUnixSocketURL - Unix socket URLs request the API of API_VERSION over the socket, other URLs are used as given
+func TestUnixSocketURL(t *testing.T) {
+
+	defer func(mode string) { apiMode = mode }(apiMode)
+
+	for _, tt := range []struct {
+		apiMode    string
+		rancherURL string
+		socketPath string
+		baseURL    string
+	}{
+		{"v2-beta", "http://rancher:8080/v2-beta", "", "http://rancher:8080/v2-beta"},
+		{"v2-beta", "unix:///var/run/rancher.sock", "/var/run/rancher.sock", "http://unix/v2-beta"},
+		{"v3", "unix:///var/run/rancher.sock", "/var/run/rancher.sock", "http://unix/v3"},
+	} {
+		apiMode = tt.apiMode
+		socketPath, baseURL := unixSocketURL(tt.rancherURL)
+		if socketPath != tt.socketPath || baseURL != tt.baseURL {
+			t.Errorf("%s %s: got %q, %q, want %q, %q", tt.apiMode, tt.rancherURL, socketPath, baseURL, tt.socketPath, tt.baseURL)
+		}
+	}
+}
+
+// BenchmarkProcessMetrics - Processes 10k services, the bulk of the work in a scrape of a large environment
+func BenchmarkProcessMetrics(b *testing.B) {
+
+	e := newTestExporter("http://rancher/v2-beta")
+	if err := e.processMetrics(benchmarkData(b, "stacks", 1000), "stacks", true, nil); err != nil {
+		b.Fatal(err)
+	}
+	services := benchmarkData(b, "services", 10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.resetGaugeVecs()
+		e.pendingCounts = make(map[string][]cachedCount)
+		if err := e.processMetrics(services, "services", true, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRetrieveStackRef - Resolves stack names across 10k stored stacks, once per service in a scrape
+func BenchmarkRetrieveStackRef(b *testing.B) {
+
+	e := newTestExporter("http://rancher/v2-beta")
+	for i := 0; i < 10000; i++ {
+		e.storeStackRef("1a5", fmt.Sprintf("1st%d", i), fmt.Sprintf("stack-%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.retrieveStackRef("1a5", "1st9999")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyProbeInterval - Minimum wait between the API root probes made for /ready, until the Rancher API is first fetched
+const readyProbeInterval = 10 * time.Second
+
+// scrapeHistory - Ring buffer holding the outcome of the most recent scrapes
+type scrapeHistory struct {
+	mutex    sync.Mutex
+	outcomes []bool
+	next     int
+	count    int
+	fetched  bool
+}
+
+// newScrapeHistory - Creates a scrapeHistory able to hold the last `size` outcomes
+func newScrapeHistory(size int) *scrapeHistory {
+	return &scrapeHistory{outcomes: make([]bool, size)}
+}
+
+// record - Stores the outcome of a scrape, overwriting the oldest entry once the buffer is full
+func (h *scrapeHistory) record(success bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.outcomes[h.next] = success
+	h.next = (h.next + 1) % len(h.outcomes)
+	if h.count < len(h.outcomes) {
+		h.count++
+	}
+	if success {
+		h.fetched = true
+	}
+}
+
+// markFetched - Records that a request to the Rancher API has succeeded, outside of a scrape
+func (h *scrapeHistory) markFetched() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.fetched = true
+}
+
+// hasFetched - Returns whether any request to the Rancher API has succeeded since startup
+func (h *scrapeHistory) hasFetched() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.fetched
+}
+
+// failures - Returns the number of recorded scrapes, and how many of those failed
+func (h *scrapeHistory) failures() (int, int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var failed int
+	for i := 0; i < h.count; i++ {
+		if !h.outcomes[i] {
+			failed++
+		}
+	}
+	return h.count, failed
+}
+
+// healthz - Reports the process is alive, whatever the state of the Rancher API
+func healthz(w http.ResponseWriter, r *http.Request) {
+
+	fmt.Fprintln(w, "ok")
+}
+
+// cachedProbe - Probes the API root, at most once per readyProbeInterval, otherwise returning the outcome of the
+// latest probe
+func (e *Exporter) cachedProbe(now time.Time) error {
+
+	e.probeMutex.Lock()
+	defer e.probeMutex.Unlock()
+
+	if !e.lastProbe.IsZero() && now.Sub(e.lastProbe) < readyProbeInterval {
+		return e.probeErr
+	}
+	e.lastProbe = now
+	e.probeErr = e.probe()
+	return e.probeErr
+}
+
+// readyStatus - Ready once the Rancher API has been fetched, and for as long as the failed scrapes in the recent
+// window stay below the configured threshold. With a background refresh, the API has been fetched once the first
+// refresh succeeds, as nothing is served before then. Otherwise the startup check or a scrape counts, and until
+// either succeeds the API root is probed again, rate limited by cachedProbe.
+func (e *Exporter) readyStatus() (bool, string) {
+
+	if refreshInterval > 0 {
+		e.mutex.RLock()
+		refreshed := !e.lastRefresh.IsZero()
+		e.mutex.RUnlock()
+
+		if !refreshed {
+			return false, "not ready: the first background refresh has not succeeded yet"
+		}
+	} else if !e.history.hasFetched() {
+		if err := e.cachedProbe(time.Now()); err != nil {
+			return false, fmt.Sprintf("not ready: the Rancher API has not been fetched yet: %s", err)
+		}
+	}
+
+	recorded, failed := e.history.failures()
+
+	if recorded >= e.healthThreshold && failed >= e.healthThreshold {
+		return false, fmt.Sprintf("not ready: %d of the last %d scrapes failed", failed, recorded)
+	}
+	return true, fmt.Sprintf("ok: %d of the last %d scrapes failed", failed, recorded)
+}
+
+// readyz - Reports not ready until the Rancher API has been fetched, or once recent scrapes keep failing
+func (e *Exporter) readyz(w http.ResponseWriter, r *http.Request) {
+
+	ok, status := e.readyStatus()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, status)
+}
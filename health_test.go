@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReadyProbe - Until the API is fetched, /ready probes the API root again, at most once per readyProbeInterval
+func TestReadyProbe(t *testing.T) {
+
+	var hits, status int32 = 0, http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	e := newTestExporter(srv.URL + "/v2-beta")
+	now := time.Now()
+
+	if err := e.cachedProbe(now); err == nil {
+		t.Fatal("expected the startup probe to fail")
+	}
+	if ok, _ := e.readyStatus(); ok {
+		t.Fatal("expected not ready after a failed startup probe")
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected the failed probe to be cached, got %d requests", n)
+	}
+
+	// Once the interval passes, the next check probes again
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := e.cachedProbe(now.Add(readyProbeInterval)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, status := e.readyStatus(); !ok {
+		t.Fatalf("expected ready once the probe succeeds, got %q", status)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
+
+// TestReadyRefresh - With a background refresh, /ready waits for the first refresh whatever the startup probe found
+func TestReadyRefresh(t *testing.T) {
+
+	defer func(interval time.Duration) { refreshInterval = interval }(refreshInterval)
+	refreshInterval = time.Minute
+
+	srv := newTestServer(nil)
+	defer srv.Close()
+
+	e := newTestExporter(srv.URL + "/v2-beta")
+	if err := e.cachedProbe(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := e.readyStatus(); ok {
+		t.Fatal("expected not ready before the first background refresh")
+	}
+
+	if !e.refreshCache() {
+		t.Fatal("expected the refresh to succeed")
+	}
+	if ok, status := e.readyStatus(); !ok {
+		t.Fatalf("expected ready after the first background refresh, got %q", status)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// instanceName - Names must be usable as a suffix of the per instance environment variables
+var instanceName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// instance - A Rancher server gathered by the exporter, with the credentials used to talk to it
+type instance struct {
+	name          string
+	url           string
+	accessKey     string
+	secretKey     string
+	environmentID string
+}
+
+// parseInstances - Parses the comma separated name=url pairs of RANCHER_INSTANCES, e.g. prod=https://rancher-prod/v2-beta.
+// The environment ID is read from CATTLE_ENVIRONMENT_ID_<NAME>, and credentials from CATTLE_ACCESS_KEY_<NAME> etc,
+// falling back to those ENV_CREDENTIALS_FILE maps to the environment, then to the shared values.
+func parseInstances(list []string) ([]instance, error) {
+
+	var instances []instance
+	names := make(map[string]bool)
+
+	for _, pair := range list {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected name=url", pair)
+		}
+		if !instanceName.MatchString(kv[0]) {
+			return nil, fmt.Errorf("invalid name %q, names must match [A-Za-z0-9_]+", kv[0])
+		}
+		if names[kv[0]] {
+			return nil, fmt.Errorf("name %q is used more than once", kv[0])
+		}
+		names[kv[0]] = true
+
+		suffix := "_" + strings.ToUpper(kv[0])
+		envID := getEnv("CATTLE_ENVIRONMENT_ID"+suffix, environmentID)
+		creds := credentialsFor(envID)
+		instances = append(instances, instance{
+			name:          kv[0],
+			url:           kv[1],
+			accessKey:     getEnv("CATTLE_ACCESS_KEY"+suffix, creds.accessKey),
+			secretKey:     getEnv("CATTLE_SECRET_KEY"+suffix, creds.secretKey),
+			environmentID: envID,
+		})
+	}
+	return instances, nil
+}
+
+// instanceSet - The exporters of every configured instance, serving the health and snapshot endpoints across them
+type instanceSet []*Exporter
+
+// readyz - Reports not ready when any of the instances isn't, with a line per instance
+func (s instanceSet) readyz(w http.ResponseWriter, r *http.Request) {
+
+	if len(s) == 1 {
+		s[0].readyz(w, r)
+		return
+	}
+
+	ready := true
+	var lines []string
+	for _, e := range s {
+		ok, status := e.readyStatus()
+		ready = ready && ok
+		lines = append(lines, e.instance+" "+status)
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// snapshotJSON - Returns the snapshot of the instance named by the instance parameter, or the first instance
+func (s instanceSet) snapshotJSON(w http.ResponseWriter, r *http.Request) {
+
+	name := r.URL.Query().Get("instance")
+	if name == "" {
+		s[0].snapshotJSON(w, r)
+		return
+	}
+
+	for _, e := range s {
+		if e.instance == name {
+			e.snapshotJSON(w, r)
+			return
+		}
+	}
+	http.Error(w, "unknown instance "+name, http.StatusNotFound)
+}
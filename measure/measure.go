@@ -6,7 +6,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-//
 var (
 	// FunctionDurations - Create a summary to track elapsed time of our key functions
 	FunctionDurations = prometheus.NewSummaryVec(
@@ -23,13 +22,34 @@ var (
 			Help: "total count of function calls",
 		}, []string{"pkg", "fnc"})
 
+	// FunctionRetriesTotal - Create a counter to track retried executions of the functions
+	FunctionRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "function_retries_total",
+			Help: "total count of function call retries",
+		}, []string{"pkg", "fnc"})
+
 	start = time.Now()
 )
 
 // Init registers the prometheus metrics for the measurement of the exporter itsself.
+// It is safe to call more than once, collectors already registered are reused.
 func Init() {
 
-	prometheus.MustRegister(FunctionDurations)
-	prometheus.MustRegister(FunctionCountTotal)
+	FunctionDurations = register(FunctionDurations).(*prometheus.SummaryVec)
+	FunctionCountTotal = register(FunctionCountTotal).(*prometheus.CounterVec)
+	FunctionRetriesTotal = register(FunctionRetriesTotal).(*prometheus.CounterVec)
+
+}
+
+// register - Registers the collector, returning the existing collector if an identical one is already registered.
+func register(c prometheus.Collector) prometheus.Collector {
 
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
 }
@@ -0,0 +1,26 @@
+package measure
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestInitTwice - A second Init reuses the collectors already registered, rather than panicking on the duplicate
+func TestInitTwice(t *testing.T) {
+
+	Init()
+	registered := FunctionCountTotal
+
+	// An identical collector, as a second copy of the package's vars would create
+	FunctionCountTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "function_count_totals",
+			Help: "total count of function calls",
+		}, []string{"pkg", "fnc"})
+	Init()
+
+	if FunctionCountTotal != registered {
+		t.Fatal("expected the registered FunctionCountTotal to be reused")
+	}
+}
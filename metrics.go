@@ -1,11 +1,23 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// endpointMetrics - The GaugeVecs set while processing the objects of each endpoint, by their `gaugeVecs` key
+var endpointMetrics = map[string][]string{
+	"hosts":        {"hostsState", "hostAgentsState", "hostInfo", "hostsByAgentState", "hostsByLabel"},
+	"stacks":       {"stacksHealth", "stacksState", "stackInfo", "stacksStuck"},
+	"services":     {"servicesScale", "servicesHealth", "servicesState", "serviceInfo", "serviceMismatch", "stackServiceHealth", "servicesScaling", "distinctImages", "publishedPorts", "externalServicesCount", "externalServiceInfo", "clusterScaleFulfillment"},
+	"containers":   {"containerState", "containerRestarts"},
+	"certificates": {"certificateExpiry"},
+}
+
 // addMetrics - Add's all of the GuageVecs to the `guageVecs` map, returns the map.
 func addMetrics() map[string]*prometheus.GaugeVec {
 
@@ -17,33 +29,122 @@ func addMetrics() map[string]*prometheus.GaugeVec {
 			Namespace: "rancher",
 			Name:      "stack_health_status",
 			Help:      "HealthState of defined stack as reported by Rancher",
-		}, []string{"name", "health_state", "system"})
+		}, []string{stackLabelKey, "environment_name", "health_state", "system"})
 	gaugeVecs["stacksState"] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "rancher",
 			Name:      "stack_state",
 			Help:      "State of defined stack as reported by Rancher",
-		}, []string{"name", "state", "system"})
+		}, []string{stackLabelKey, "environment_name", "state", "system"})
+	gaugeVecs["stackInfo"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "stack_info",
+			Help:      "ID of the stack as reported by the Rancher API, always (1)",
+		}, []string{stackLabelKey, "environment_name", "id"})
+	gaugeVecs["stackServiceHealth"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "stack_service_health",
+			Help:      "Number of services in each health state, by the stack they belong to",
+		}, []string{"stack_name", "environment_name", "health_state"})
+	gaugeVecs["stacksStuck"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "stacks_stuck",
+			Help:      "Number of stacks in each transitioning state for longer than STUCK_THRESHOLD",
+		}, []string{"state"})
 
 	// Service Metrics
 	gaugeVecs["servicesScale"] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "rancher",
 			Name:      "service_scale",
-			Help:      "scale of defined service as reported by Rancher",
-		}, []string{"name", "stack_name"})
+			Help:      "scale of defined service as reported by Rancher, either the desired scale or the containers currently running",
+		}, []string{serviceLabelKey, "stack_name", "environment_name", "type"})
 	gaugeVecs["servicesHealth"] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "rancher",
 			Name:      "service_health_status",
 			Help:      "HealthState of the service, as reported by the Rancher API. Either (1) or (0)",
-		}, []string{"name", "stack_name", "health_state"})
+		}, []string{serviceLabelKey, "stack_name", "environment_name", "health_state"})
 	gaugeVecs["servicesState"] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "rancher",
 			Name:      "service_state",
 			Help:      "State of the service, as reported by the Rancher API",
-		}, []string{"name", "stack_name", "state"})
+		}, []string{serviceLabelKey, "stack_name", "environment_name", "state"})
+
+	gaugeVecs["clusterScaleFulfillment"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "cluster_scale_fulfillment",
+			Help:      "Sum of the running scale over the sum of the desired scale across all services, below (1) when desired capacity isn't met",
+		}, []string{})
+	gaugeVecs["serviceInfo"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "service_info",
+			Help:      "ID of the service as reported by the Rancher API, always (1)",
+		}, []string{serviceLabelKey, "stack_name", "environment_name", "id"})
+	gaugeVecs["serviceMismatch"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "service_state_health_mismatch",
+			Help:      "Set to (1) when a service's state and health disagree, as defined by SERVICE_MISMATCH_RULES",
+		}, []string{serviceLabelKey, "stack_name", "environment_name"})
+	gaugeVecs["servicesScaling"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "services_scaling",
+			Help:      "Number of transitioning services whose running scale is below (up) or above (down) their desired scale",
+		}, []string{"direction"})
+	gaugeVecs["distinctImages"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "distinct_images",
+			Help:      "Number of distinct images used across all services",
+		}, []string{})
+	gaugeVecs["publishedPorts"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "published_ports",
+			Help:      "Number of services publishing each port on a host, from their public endpoints",
+		}, []string{"port"})
+	gaugeVecs["externalServicesCount"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "external_services_count",
+			Help:      "Number of external services, pointing outside of Rancher, as reported by the Rancher API",
+		}, []string{})
+	gaugeVecs["externalServiceInfo"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "external_service_info",
+			Help:      "Target of an external service as reported by the Rancher API, always (1)",
+		}, []string{serviceLabelKey, "stack_name", "environment_name", "hostname", "external_ips"})
+
+	// Container Metrics
+	gaugeVecs["containerState"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "container_state",
+			Help:      "State and health of the container as reported by the Rancher API, always (1)",
+		}, []string{"name", "service_name", "stack_name", "environment_name", "host", "state", "health_state"})
+	gaugeVecs["containerRestarts"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "container_restart_count",
+			Help:      "Number of times the container has been restarted, from the start count reported by the Rancher API",
+		}, []string{"name", "service_name", "stack_name", "environment_name", "host"})
+
+	// Certificate Metrics
+	gaugeVecs["certificateExpiry"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "certificate_expiry_timestamp_seconds",
+			Help:      "Expiry of the certificate as reported by the Rancher API, in seconds since the epoch",
+		}, []string{"name", "cn", "environment"})
 
 	// Host Metrics
 	gaugeVecs["hostsState"] = prometheus.NewGaugeVec(
@@ -51,27 +152,429 @@ func addMetrics() map[string]*prometheus.GaugeVec {
 			Namespace: "rancher",
 			Name:      ("host_state"),
 			Help:      "State of defined host as reported by the Rancher API",
-		}, []string{"name", "state"})
+		}, []string{hostLabelKey, "environment_name", "state"})
 	gaugeVecs["hostAgentsState"] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "rancher",
 			Name:      ("host_agent_state"),
 			Help:      "State of defined host agent as reported by the Rancher API",
+		}, []string{hostLabelKey, "environment_name", "state"})
+
+	gaugeVecs["hostInfo"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "host_info",
+			Help:      "Environment and ID of the host as reported by the Rancher API, always (1)",
+		}, []string{hostLabelKey, "environment_name", "id"})
+	gaugeVecs["hostsByAgentState"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "hosts_by_agent_state",
+			Help:      "Number of hosts in each agent state as reported by the Rancher API",
+		}, []string{"agent_state"})
+
+	gaugeVecs["hostsByLabel"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "hosts_by_label",
+			Help:      "Number of hosts with each value of the allowlisted host label keys",
+		}, []string{"label_key", "label_value"})
+
+	// Server Metrics
+	gaugeVecs["serverVersion"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "server_version_info",
+			Help:      "Version of the Rancher server and the API version its schemas are served under, always (1)",
+		}, []string{"version", "schema"})
+
+	// Exporter Metrics
+	gaugeVecs["serverHealthy"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "server_healthy",
+			Help:      "Whether the Rancher server's own health check, SERVER_HEALTH_PATH, reported healthy. Either (1) or (0)",
+		}, []string{})
+	gaugeVecs["endpointPaginated"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "endpoint_paginated",
+			Help:      "Whether the endpoint spans more than one page of API responses, gathered or not. Either (1) or (0)",
+		}, []string{"endpoint"})
+	gaugeVecs["apiAvgResponse"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "api_avg_response_seconds",
+			Help:      "Exponentially weighted moving average of the Rancher API response time, by endpoint",
+		}, []string{"endpoint"})
+	gaugeVecs["endpointUp"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "exporter_endpoint_up",
+			Help:      "Whether the endpoint was gathered and processed by the last scrape. Either (1) or (0)",
+		}, []string{"endpoint"})
+	gaugeVecs["endpointScrapeDuration"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "exporter_endpoint_scrape_duration_seconds",
+			Help:      "Time taken to gather the endpoint during the last scrape",
+		}, []string{"endpoint"})
+	gaugeVecs["lastRefresh"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "exporter_last_refresh_timestamp_seconds",
+			Help:      "Time of the last successful background refresh of the Rancher API, in seconds since the epoch",
+		}, []string{})
+	gaugeVecs["refreshStale"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "exporter_refresh_stale",
+			Help:      "Whether the metrics served are older than two API_REFRESH_INTERVAL, either (1) or (0)",
+		}, []string{})
+	gaugeVecs["paginationTruncated"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "pagination_truncated",
+			Help:      "Whether MAX_PAGES stopped gathering the endpoint before its last page. Either (1) or (0)",
+		}, []string{"endpoint"})
+	gaugeVecs["stackRefEntries"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "stackref_entries",
+			Help:      "Number of stack ID to stack name mappings cached by the exporter",
+		}, []string{})
+	gaugeVecs["apiCalls"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "api_calls",
+			Help:      "Number of requests made to the Rancher API during the last scrape",
+		}, []string{})
+	gaugeVecs["scrapeRetries"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "scrape_retries",
+			Help:      "Number of requests to the Rancher API retried during the last scrape",
+		}, []string{})
+	gaugeVecs["probeSuccess"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "probe_success",
+			Help:      "Whether the last scrape of the Rancher API succeeded, mirroring blackbox_exporter. Either (1) or (0)",
+		}, []string{})
+	gaugeVecs["probeDuration"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "probe_duration_seconds",
+			Help:      "Duration of the last scrape of the Rancher API in seconds, mirroring blackbox_exporter",
+		}, []string{})
+	gaugeVecs["expectedSeries"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "expected_series",
+			Help:      "Number of per object series the last scrape of the endpoint should have emitted",
+		}, []string{"endpoint"})
+	gaugeVecs["objectsSkipped"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "objects_skipped",
+			Help:      "Number of objects skipped during the last scrape of the endpoint, by reason",
+		}, []string{"endpoint", "reason"})
+	gaugeVecs["countsStale"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "counts_stale",
+			Help:      "Whether the count metrics are cached values from the last successful scrape. Either (1) or (0)",
+		}, []string{})
+
+	// Rancher 2.x (v3) Metrics
+	gaugeVecs["clusterState"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "cluster_state",
+			Help:      "State of the cluster as reported by the Rancher v3 API, always (1)",
 		}, []string{"name", "state"})
+	gaugeVecs["nodeState"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "node_state",
+			Help:      "State of the node as reported by the Rancher v3 API, always (1)",
+		}, []string{"name", "cluster", "state"})
+	gaugeVecs["projectState"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "project_state",
+			Help:      "State of the project as reported by the Rancher v3 API, always (1)",
+		}, []string{"name", "cluster", "state"})
+	gaugeVecs["workloadState"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "workload_state",
+			Help:      "State of the workload as reported by the Rancher v3 API, always (1)",
+		}, []string{"name", "project", "namespace", "state"})
+	gaugeVecs["workloadScale"] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "workload_scale",
+			Help:      "Scale of the workload as reported by the Rancher v3 API",
+		}, []string{"name", "project", "namespace"})
 
 	return gaugeVecs
 }
 
+// addCounters - Add's all of the CounterVecs to the `counterVecs` map, returns the map.
+// Unlike the GaugeVecs these are never reset, so accumulate for the lifetime of the exporter.
+func addCounters() map[string]*prometheus.CounterVec {
+
+	counterVecs := make(map[string]*prometheus.CounterVec)
+
+	counterVecs["apiSchemaChanged"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "api_schema_changed_total",
+			Help:      "Number of times the Rancher server version or API schema changed between scrapes",
+		}, []string{})
+	counterVecs["decodeErrors"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "decode_errors_total",
+			Help:      "Number of responses from the Rancher API that could not be decoded, by endpoint",
+		}, []string{"endpoint"})
+	counterVecs["envNameCollisions"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "environment_name_collisions_total",
+			Help:      "Number of distinct pairs of environments found sharing a name, counted once when first found, both then being labelled with their ID",
+		}, []string{})
+	counterVecs["hostEnvironmentMisses"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "host_environment_unresolved_total",
+			Help:      "Number of times a host's environment could not be resolved from its accountId",
+		}, []string{})
+	counterVecs["hostReconnects"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "host_reconnects_total",
+			Help:      "Number of times the host's agent was seen moving into the reconnecting state since the exporter started",
+		}, []string{hostLabelKey})
+	counterVecs["objectsFiltered"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "objects_filtered_total",
+			Help:      "Number of objects left out by the stack, service and host filters, by endpoint and the setting that filtered them",
+		}, []string{"endpoint", "rule"})
+	counterVecs["responseLimitExceeded"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "response_limit_exceeded_total",
+			Help:      "Number of responses from the Rancher API discarded for exceeding MAX_RESPONSE_BYTES, by endpoint",
+		}, []string{"endpoint"})
+	counterVecs["scrapeErrors"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "scrape_errors_total",
+			Help:      "Number of times gathering or processing an endpoint failed the scrape, by endpoint",
+		}, []string{"endpoint"})
+	counterVecs["scrapeFailures"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "scrape_failures_total",
+			Help:      "Number of times gathering or processing an endpoint failed the scrape since startup, summed across all endpoints",
+		}, []string{})
+
+	counterVecs["scrapeCycles"] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "rancher",
+			Name:      "scrape_cycles_total",
+			Help:      "Number of scrapes completed since startup, whether or not they succeeded",
+		}, []string{})
+
+	// Initialised so the scrape error counters are exported from startup, before any failure
+	counterVecs["scrapeFailures"].WithLabelValues()
+	for _, p := range endpoints {
+		counterVecs["scrapeErrors"].WithLabelValues(p)
+	}
+
+	return counterVecs
+}
+
+// checkLabelKeys - Registers a throwaway set of the exporter's metrics, returning an error naming any metric where
+// a configured label key duplicates another of its labels, including the rancher_instance label of named instances
+func checkLabelKeys(named bool) error {
+
+	reg := prometheus.NewRegistry()
+	var r prometheus.Registerer = reg
+	if named {
+		r = prometheus.WrapRegistererWith(prometheus.Labels{"rancher_instance": "check"}, reg)
+	}
+
+	for _, m := range addMetrics() {
+		if err := r.Register(m); err != nil {
+			return err
+		}
+	}
+	for _, m := range addCounters() {
+		if err := r.Register(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerConfigMetrics - Registers an info metric for each boolean runtime setting, reflecting its active value.
+// The configuration is fixed at startup, so these are registered once rather than being set on each scrape.
+func registerConfigMetrics(configs map[string]bool) {
+
+	for name, value := range configs {
+		g := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "rancher",
+				Name:      "config_" + name,
+				Help:      "Active value of the " + name + " setting, always (1)",
+			}, []string{"value"})
+		g.WithLabelValues(strconv.FormatBool(value)).Set(1)
+		prometheus.MustRegister(g)
+	}
+}
+
+// registerEndpointMetrics - Registers an info metric naming each endpoint the exporter is configured to gather.
+func registerEndpointMetrics(endpoints []string) {
+
+	g := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "rancher",
+			Name:      "config_endpoint_enabled",
+			Help:      "Endpoint the exporter is configured to gather, always (1)",
+		}, []string{"endpoint"})
+	for _, p := range endpoints {
+		g.WithLabelValues(p).Set(1)
+	}
+	prometheus.MustRegister(g)
+}
+
+// cachedCount - A count metric value, kept so it can be re-emitted should a later scrape fail
+type cachedCount struct {
+	metric string
+	labels []string
+	value  float64
+}
+
+// setCount - Sets a count metric, and records it as part of the current scrape's counts for the endpoint
+func (e *Exporter) setCount(endpoint string, metric string, value float64, labels ...string) {
+
+	e.gaugeVecs[metric].WithLabelValues(labels...).Set(value)
+	e.pendingCounts[endpoint] = append(e.pendingCounts[endpoint], cachedCount{metric: metric, labels: labels, value: value})
+}
+
+// keepCounts - Retains the counts set by the current scrape of the endpoint, once it has succeeded
+func (e *Exporter) keepCounts(endpoint string) {
+
+	e.lastCounts[endpoint] = e.pendingCounts[endpoint]
+}
+
+// replayCounts - When STALE_COUNTS is set, re-emits the counts from the last successful scrape of a failed endpoint,
+// flagging them as stale
+func (e *Exporter) replayCounts(endpoint string) {
+
+	counts, ok := e.lastCounts[endpoint]
+	if !e.staleCounts || !ok {
+		return
+	}
+	for _, c := range counts {
+		e.gaugeVecs[c.metric].WithLabelValues(c.labels...).Set(c.value)
+	}
+	e.gaugeVecs["countsStale"].WithLabelValues().Set(1)
+}
+
+// seriesPerObject - Returns how many series the state metrics emit for a single object of the endpoint
+func seriesPerObject(endpoint string) int {
+
+	switch endpoint {
+	case "hosts":
+		return len(hostStates) + len(agentStates)
+	case "stacks":
+		return len(healthStates) + len(stackStates)
+	case "services":
+		return 2 + len(healthStates) + len(serviceStates)
+	case "containers":
+		return 2
+	case "certificates":
+		return 1
+	}
+	return 0
+}
+
+// transition - The transitioning state an object was last seen in, and since when
+type transition struct {
+	state string
+	since time.Time
+}
+
+// trackTransition - Records how long an object has been in its current transitioning state,
+// restarting the timer whenever the state changes. Returns zero for objects not transitioning.
+func (e *Exporter) trackTransition(id string, state string, now time.Time) time.Duration {
+
+	if !isTransitioning(state) {
+		delete(e.transitions, id)
+		return 0
+	}
+
+	t, ok := e.transitions[id]
+	if !ok || t.state != state {
+		t = transition{state: state, since: now}
+		e.transitions[id] = t
+	}
+	return now.Sub(t.since)
+}
+
+// checkState - Applies ON_UNKNOWN_STATE to a state missing from the states known to the exporter,
+// which would otherwise only show as every state series being (0). Empty states are left alone.
+func checkState(kind string, state string, known []string) error {
+
+	if state == "" || onUnknownState == "ignore" {
+		return nil
+	}
+	for _, y := range known {
+		if state == y {
+			return nil
+		}
+	}
+
+	if onUnknownState == "fail" {
+		return fmt.Errorf("unknown %s %q", kind, state)
+	}
+	log.Warnf("Unknown %s %q reported by the API, no series will be set for it", kind, state)
+	return nil
+}
+
+// isTransitioning - Checks whether the state is one an object passes through while changing
+func isTransitioning(state string) bool {
+
+	for _, y := range transitStates {
+		if state == y {
+			return true
+		}
+	}
+	return false
+}
+
 // checkMetric - Checks the base type stored in the API is correct, this ensures we are setting the right metric for the right endpoint.
 func checkMetric(endpoint string, baseType string) bool {
 
 	e := strings.TrimSuffix(endpoint, "s")
 
+	// Types matching a configured regex for the endpoint are accepted, in addition to the built-in matches
+	if r, ok := acceptTypes[endpoint]; ok && r.MatchString(baseType) {
+		return true
+	}
+
 	// Backwards compatibility fix, the API in V1 wrong, this is to cover v1 usage.
 	if baseType == "environment" && e == "stack" {
 		return true
 	} else if e == "service" && (baseType == "externalService" || baseType == "loadBalancerService") {
 		return true
+	} else if e == "container" && baseType == "instance" {
+		return true
 	} else if e != baseType {
 		log.Errorf("API MisMatch, expected %s metric, got %s metric", e, baseType)
 		return false
@@ -82,23 +585,33 @@ func checkMetric(endpoint string, baseType string) bool {
 }
 
 // setServiceMetrics - Logic to set the state of a system as a gauge metric
-func (e *Exporter) setServiceMetrics(name string, stack string, state string, health string, scale int) error {
+func (e *Exporter) setServiceMetrics(name string, stack string, env string, state string, health string, scale int, currentScale int) error {
+
+	if err := checkState("service health state", health, healthStates); err != nil {
+		return err
+	}
+	if err := checkState("service state", state, serviceStates); err != nil {
+		return err
+	}
 
-	e.gaugeVecs["servicesScale"].With(prometheus.Labels{"name": name, "stack_name": stack}).Set(float64(scale))
+	e.gaugeVecs["servicesScale"].WithLabelValues(name, stack, env, "desired").Set(float64(scale))
+	e.gaugeVecs["servicesScale"].WithLabelValues(name, stack, env, "current").Set(float64(currentScale))
 
+	healthVec := e.gaugeVecs["servicesHealth"]
 	for _, y := range healthStates {
 		if health == y {
-			e.gaugeVecs["servicesHealth"].With(prometheus.Labels{"name": name, "stack_name": stack, "health_state": y}).Set(1)
+			healthVec.WithLabelValues(name, stack, env, y).Set(1)
 		} else {
-			e.gaugeVecs["servicesHealth"].With(prometheus.Labels{"name": name, "stack_name": stack, "health_state": y}).Set(0)
+			healthVec.WithLabelValues(name, stack, env, y).Set(0)
 		}
 	}
 
+	stateVec := e.gaugeVecs["servicesState"]
 	for _, y := range serviceStates {
 		if state == y {
-			e.gaugeVecs["servicesState"].With(prometheus.Labels{"name": name, "stack_name": stack, "state": y}).Set(1)
+			stateVec.WithLabelValues(name, stack, env, y).Set(1)
 		} else {
-			e.gaugeVecs["servicesState"].With(prometheus.Labels{"name": name, "stack_name": stack, "state": y}).Set(0)
+			stateVec.WithLabelValues(name, stack, env, y).Set(0)
 		}
 
 	}
@@ -106,20 +619,51 @@ func (e *Exporter) setServiceMetrics(name string, stack string, state string, he
 
 }
 
+// setExternalServiceMetrics - Sets the info metric describing where an external service points
+func (e *Exporter) setExternalServiceMetrics(name string, stack string, env string, hostname string, externalIPs []string) {
+
+	e.gaugeVecs["externalServiceInfo"].WithLabelValues(name, stack, env, hostname, strings.Join(externalIPs, ",")).Set(1)
+}
+
+// setContainerMetrics - Sets the state, health and restarts of a container, alongside the service, stack, environment
+// and host it belongs to
+func (e *Exporter) setContainerMetrics(name string, service string, stack string, env string, host string, state string, health string, starts int) {
+
+	e.gaugeVecs["containerState"].WithLabelValues(name, service, stack, env, host, state, health).Set(1)
+
+	// The first start isn't a restart, containers never started have no restarts either
+	restarts := starts - 1
+	if restarts < 0 {
+		restarts = 0
+	}
+	e.gaugeVecs["containerRestarts"].WithLabelValues(name, service, stack, env, host).Set(float64(restarts))
+}
+
 // setStackMetrics - Logic to set the state of a system as a gauge metric
-func (e *Exporter) setStackMetrics(name string, state string, health string, system string) error {
+func (e *Exporter) setStackMetrics(name string, env string, state string, health string, system string) error {
+
+	if err := checkState("stack health state", health, healthStates); err != nil {
+		return err
+	}
+	if err := checkState("stack state", state, stackStates); err != nil {
+		return err
+	}
+
+	healthVec := e.gaugeVecs["stacksHealth"]
 	for _, y := range healthStates {
 		if health == y {
-			e.gaugeVecs["stacksHealth"].With(prometheus.Labels{"name": name, "health_state": y, "system": system}).Set(1)
+			healthVec.WithLabelValues(name, env, y, system).Set(1)
 		} else {
-			e.gaugeVecs["stacksHealth"].With(prometheus.Labels{"name": name, "health_state": y, "system": system}).Set(0)
+			healthVec.WithLabelValues(name, env, y, system).Set(0)
 		}
 	}
+
+	stateVec := e.gaugeVecs["stacksState"]
 	for _, y := range stackStates {
 		if state == y {
-			e.gaugeVecs["stacksState"].With(prometheus.Labels{"name": name, "state": y, "system": system}).Set(1)
+			stateVec.WithLabelValues(name, env, y, system).Set(1)
 		} else {
-			e.gaugeVecs["stacksState"].With(prometheus.Labels{"name": name, "state": y, "system": system}).Set(0)
+			stateVec.WithLabelValues(name, env, y, system).Set(0)
 		}
 
 	}
@@ -127,21 +671,31 @@ func (e *Exporter) setStackMetrics(name string, state string, health string, sys
 }
 
 // setHostMetrics - Logic to set the state of a system as a gauge metric
-func (e *Exporter) setHostMetrics(name string, state, agentState string) error {
+func (e *Exporter) setHostMetrics(name string, env string, state, agentState string) error {
+
+	if err := checkState("host state", state, hostStates); err != nil {
+		return err
+	}
+	if err := checkState("host agent state", agentState, agentStates); err != nil {
+		return err
+	}
 
+	stateVec := e.gaugeVecs["hostsState"]
 	for _, y := range hostStates {
 		if state == y {
-			e.gaugeVecs["hostsState"].With(prometheus.Labels{"name": name, "state": y}).Set(1)
+			stateVec.WithLabelValues(name, env, y).Set(1)
 		} else {
-			e.gaugeVecs["hostsState"].With(prometheus.Labels{"name": name, "state": y}).Set(0)
+			stateVec.WithLabelValues(name, env, y).Set(0)
 		}
 
 	}
+
+	agentVec := e.gaugeVecs["hostAgentsState"]
 	for _, y := range agentStates {
 		if agentState == y {
-			e.gaugeVecs["hostAgentsState"].With(prometheus.Labels{"name": name, "state": y}).Set(1)
+			agentVec.WithLabelValues(name, env, y).Set(1)
 		} else {
-			e.gaugeVecs["hostAgentsState"].With(prometheus.Labels{"name": name, "state": y}).Set(0)
+			agentVec.WithLabelValues(name, env, y).Set(0)
 		}
 
 	}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -13,12 +18,27 @@ func (e *Exporter) resetGaugeVecs() {
 	}
 }
 
+// resetEndpoint - Resets the guageVecs set while processing the endpoint,
+// discarding the metrics left behind when processing fails part way through
+func (e *Exporter) resetEndpoint(endpoint string) {
+
+	for _, name := range endpointMetrics[endpoint] {
+		e.gaugeVecs[name].Reset()
+	}
+}
+
 // Describe describes all the metrics ever exported by the Rancher exporter
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
 	for _, m := range e.gaugeVecs {
 		m.Describe(ch)
 	}
+	for _, m := range e.counterVecs {
+		m.Describe(ch)
+	}
 }
 
 // Collect function, called on by Prometheus Client library
@@ -27,28 +47,261 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	e.mutex.Lock() // To protect metrics from concurrent collects.
 	defer e.mutex.Unlock()
 
+	// With a background refresh, scrapes are served from the last refresh rather than calling the API
+	gaugeVecs := e.served
+	if refreshInterval > 0 {
+		e.setRefreshMetrics(time.Now())
+	} else {
+		e.refresh()
+		gaugeVecs = e.gaugeVecs
+	}
+
+	for _, m := range gaugeVecs {
+		m.Collect(ch)
+	}
+	for _, m := range e.counterVecs {
+		m.Collect(ch)
+	}
+
+}
+
+// refresh - Gathers the Rancher API into the metrics, returning whether every endpoint succeeded and, if not,
+// whether any did. Callers serialise refreshes, holding the mutex or, for the background refresh, the refreshMutex.
+func (e *Exporter) refresh() (success bool, partial bool) {
+
 	e.resetGaugeVecs() // Clean starting point
 
-	// Range over the pre-configured endpoints array
-	for _, p := range endpoints {
+	// Counts set during this scrape, only retained for the endpoints that succeed
+	e.pendingCounts = make(map[string][]cachedCount)
+	e.apiCalls = 0
+	e.retries = 0
+	e.scrapeVersion = nil
+	if e.staleCounts {
+		e.gaugeVecs["countsStale"].WithLabelValues().Set(0)
+	}
+
+	// Requests still outstanding at the scrape deadline are abandoned, the server health check included
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeDeadline)
+	defer cancel()
+
+	start := time.Now()
+	success, partial = e.scrape(ctx, nil)
+
+	// Compared once the scrape is done, the responses within a scrape all reporting the same version
+	e.compareAPIVersion()
+
+	// Record the outcome of this scrape for the health endpoint
+	e.history.record(success)
+
+	// Rancher's self reported health, which can be degraded while the API still answers
+	if serverHealthPath != "" {
+		if e.serverHealthy(ctx) {
+			e.gaugeVecs["serverHealthy"].WithLabelValues().Set(1)
+		} else {
+			e.gaugeVecs["serverHealthy"].WithLabelValues().Set(0)
+		}
+	}
+
+	// Number of requests made to the Rancher API by this scrape, the server health check included
+	e.gaugeVecs["apiCalls"].WithLabelValues().Set(float64(e.apiCalls))
+
+	// Retries made by this scrape, a nonzero count on a successful scrape being an early sign of an unstable API
+	e.gaugeVecs["scrapeRetries"].WithLabelValues().Set(float64(e.retries))
+
+	// Mirrors the blackbox_exporter probe metrics, for reuse of existing probe dashboards
+	if e.probeMetrics {
+		if success {
+			e.gaugeVecs["probeSuccess"].WithLabelValues().Set(1)
+		} else {
+			e.gaugeVecs["probeSuccess"].WithLabelValues().Set(0)
+		}
+		e.gaugeVecs["probeDuration"].WithLabelValues().Set(time.Since(start).Seconds())
+	}
+
+	// Counted whatever the outcome, confirming scrapes are happening at the expected rate
+	e.counterVecs["scrapeCycles"].WithLabelValues().Inc()
+
+	return success, partial
+}
+
+// runRefresher - Refreshes the metrics from the Rancher API once the offset has passed, then on every interval
+func (e *Exporter) runRefresher(interval time.Duration, offset time.Duration) {
+
+	time.Sleep(offset)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		e.refreshCache()
+
+		<-ticker.C
+	}
+}
+
+// startOffset - Picks a random delay of up to max before the first refresh, so a fleet of exporters started together
+// spreads its load on the Rancher API across the interval
+func startOffset(r *rand.Rand, max time.Duration) time.Duration {
+
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(r.Int63n(int64(max)))
+}
+
+// refreshCache - Refreshes the metrics from the Rancher API into the working guageVecs, then swaps them in as the
+// metrics served. The mutex is only held for the swap, so scrapes are served from the cache while the API is gathered.
+// When every endpoint fails the last good metrics are kept, with the endpoints marked down. Returns whether every
+// endpoint succeeded.
+func (e *Exporter) refreshCache() bool {
+
+	e.refreshMutex.Lock()
+	defer e.refreshMutex.Unlock()
+
+	success, partial := e.refresh()
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if success || partial {
+		e.served, e.gaugeVecs = e.gaugeVecs, e.served
+	} else {
+		for _, p := range endpoints {
+			e.served["endpointUp"].WithLabelValues(p).Set(0)
+		}
+		if e.staleCounts {
+			e.served["countsStale"].WithLabelValues().Set(1)
+		}
+		if e.probeMetrics {
+			e.served["probeSuccess"].WithLabelValues().Set(0)
+		}
+	}
+
+	if success {
+		e.lastRefresh = time.Now()
+	}
+	return success
+}
+
+// setRefreshMetrics - Sets when the metrics served were last successfully refreshed, flagging them as stale
+// once two intervals pass without a successful refresh
+func (e *Exporter) setRefreshMetrics(now time.Time) {
 
-		var data, err = e.gatherData(e.rancherURL, e.accessKey, e.secretKey, p, ch)
+	stale := 0.0
+	if e.lastRefresh.IsZero() || now.Sub(e.lastRefresh) > 2*refreshInterval {
+		stale = 1
+	}
+	e.served["refreshStale"].WithLabelValues().Set(stale)
 
-		if err != nil {
+	if !e.lastRefresh.IsZero() {
+		e.served["lastRefresh"].WithLabelValues().Set(float64(e.lastRefresh.Unix()))
+	}
+}
+
+// scrape - Gathers the pre-configured endpoints concurrently, then processes them in order so the stacks and
+// environments they refer to are stored first. Returns false if any endpoint failed, with partial set when
+// the metrics of the endpoints that succeeded have been kept.
+func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) (success bool, partial bool) {
+
+	// Rancher 2.x has a different set of collections altogether
+	if apiMode == "v3" {
+		return e.scrapeV3(ctx, ch)
+	}
+
+	// Data gathered from each endpoint, kept for the snapshot endpoint
+	gathered := make(map[string]*Data, len(endpoints))
+
+	// Environments, stacks, services and hosts are stored afresh by each scrape, before the objects referring to them
+	e.resetRefs()
+	e.objectStates = make(map[string]map[string]int)
+
+	results := gatherEach(len(endpoints), func(i int) (*Data, error) {
+		return e.gatherData(ctx, e.rancherURL, e.accessKey, e.secretKey, endpoints[i], ch)
+	})
+
+	success = true
+	for i, p := range endpoints {
+		r := results[i]
+		e.gaugeVecs["endpointScrapeDuration"].WithLabelValues(p).Set(r.duration.Seconds())
+
+		if r.err != nil {
 			log.Error("Error getting JSON from URL ", p)
-			return
+			e.scrapeFailed(p)
+			e.gaugeVecs["endpointUp"].WithLabelValues(p).Set(0)
+			e.replayCounts(p)
+			success = false
+			continue
 		}
+		gathered[p] = r.data
 
-		if err := e.processMetrics(data, p, e.hideSys, ch); err != nil {
+		if err := e.processMetrics(r.data, p, e.hideSys, ch); err != nil {
 			log.Errorf("Error scraping rancher url: %s", err)
-			return
+			e.resetEndpoint(p)
+			e.scrapeFailed(p)
+			e.gaugeVecs["endpointUp"].WithLabelValues(p).Set(0)
+			e.replayCounts(p)
+			success = false
+			continue
 		}
 		log.Infof("Metrics successfully processed for %s", p)
+		e.gaugeVecs["endpointUp"].WithLabelValues(p).Set(1)
+		e.keepCounts(p)
+		partial = true
+	}
 
+	// Size of the stack ID to name cache, rebuilt by each scrape
+	e.refMutex.RLock()
+	e.gaugeVecs["stackRefEntries"].WithLabelValues().Set(float64(len(e.stackRef)))
+	e.refMutex.RUnlock()
+
+	if !success {
+		return false, partial
 	}
 
-	for _, m := range e.gaugeVecs {
-		m.Collect(ch)
+	e.snapshot.store(gathered)
+
+	// Optionally bridge the counts into StatsD for legacy dashboards
+	if e.statsd != nil {
+		e.statsd.send(e.objectStates)
+	}
+
+	return true, false
+}
+
+// scrapeFailed - Counts a failure against the endpoint that caused it, and in the overall total
+func (e *Exporter) scrapeFailed(endpoint string) {
+	e.counterVecs["scrapeErrors"].WithLabelValues(endpoint).Inc()
+	e.counterVecs["scrapeFailures"].WithLabelValues().Inc()
+}
+
+// gatherResult - The data gathered by a request, or the error that stopped it, and how long it took
+type gatherResult struct {
+	data     *Data
+	err      error
+	duration time.Duration
+}
+
+// gatherEach - Makes the n requests of gather concurrently, at most SCRAPE_CONCURRENCY at a time,
+// returning their results in the order of the requests
+func gatherEach(n int, gather func(i int) (*Data, error)) []gatherResult {
+
+	results := make([]gatherResult, n)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, scrapeConcurrency)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			data, err := gather(i)
+			results[i] = gatherResult{data: data, err: err, duration: time.Since(start)}
+		}(i)
 	}
+	wg.Wait()
 
+	return results
 }
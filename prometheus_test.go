@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/infinityworks/prometheus-rancher-exporter/measure"
+)
+
+// TestTwoExporters - Exporters are independent of one another, each gathering into its own metrics
+func TestTwoExporters(t *testing.T) {
+
+	measure.Init()
+	measure.Init()
+
+	first := newTestServer(map[string]string{"hosts": `{"data":[{"id":"1h1","hostname":"first","type":"host","state":"active"}]}`})
+	defer first.Close()
+	second := newTestServer(map[string]string{"hosts": `{"data":[{"id":"1h1","hostname":"second","type":"host","state":"active"}]}`})
+	defer second.Close()
+
+	for _, c := range []struct {
+		url  string
+		host string
+	}{
+		{first.URL + "/v2-beta", "first"},
+		{second.URL + "/v2-beta", "second"},
+	} {
+		mfs := gatherFamilies(t, newTestExporter(c.url))
+		if v := gaugeValue(mfs["rancher_host_state"], hostLabelKey, c.host, "state", "active"); v != 1 {
+			t.Errorf("expected host %s from %s, got %v", c.host, c.url, mfs["rancher_host_state"])
+		}
+	}
+}
+
+// TestTwoInstancesRegistered - Instances registered side by side, wrapped with their rancher_instance label as main
+// does, don't collide
+func TestTwoInstancesRegistered(t *testing.T) {
+
+	reg := prometheus.NewRegistry()
+	for _, name := range []string{"prod", "staging"} {
+		srv := newTestServer(map[string]string{"hosts": `{"data":[{"id":"1h1","hostname":"` + name + `","type":"host","state":"active"}]}`})
+		defer srv.Close()
+
+		e := newTestExporter(srv.URL + "/v2-beta")
+		e.instance = name
+		if err := prometheus.WrapRegistererWith(prometheus.Labels{"rancher_instance": name}, reg).Register(e); err != nil {
+			t.Fatalf("registering %s: %s", name, err)
+		}
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "rancher_host_state" {
+			continue
+		}
+		for _, name := range []string{"prod", "staging"} {
+			if v := gaugeValue(mf, "rancher_instance", name, hostLabelKey, name, "state", "active"); v != 1 {
+				t.Errorf("expected the active host of %s, got %v", name, v)
+			}
+		}
+		return
+	}
+	t.Fatal("rancher_host_state not gathered")
+}
+
+// TestMetricsGzip - The metrics page is gzipped for scrapers accepting it, and sent uncompressed otherwise
+func TestMetricsGzip(t *testing.T) {
+
+	srv := newTestServer(nil)
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newTestExporter(srv.URL + "/v2-beta"))
+	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+
+	for _, tt := range []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"gzip", "gzip"},
+		{"", ""},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+// TestAPIVersionChanged - Responses within a scrape give one version, however their schemas are scoped, with a change
+// counted between scrapes
+func TestAPIVersionChanged(t *testing.T) {
+
+	version := "v1.6.30"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Rancher-Version", version)
+		w.Header().Set("X-Api-Schemas", "http://"+r.Host+strings.TrimSuffix(r.URL.Path, "/")+"/schemas")
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer srv.Close()
+
+	e := newTestExporter(srv.URL + "/v2-beta")
+	e.environmentID = "1a5"
+
+	for _, tt := range []struct {
+		version string
+		changes float64
+	}{
+		{"v1.6.30", 0},
+		{"v1.6.30", 0},
+		{"v1.6.31", 1},
+	} {
+		version = tt.version
+		mfs := gatherFamilies(t, e)
+
+		series := mfs["rancher_server_version_info"].GetMetric()
+		if len(series) != 1 || gaugeValue(mfs["rancher_server_version_info"], "version", tt.version, "schema", "v2-beta") != 1 {
+			t.Errorf("version %s: expected a single series for the version, got %v", tt.version, series)
+		}
+		if v := testutil.ToFloat64(e.counterVecs["apiSchemaChanged"].With(prometheus.Labels{})); v != tt.changes {
+			t.Errorf("version %s: got %v changes, want %v", tt.version, v, tt.changes)
+		}
+	}
+}
+
+// TestServerHealthCheck - The server health check is counted as an API call, and abandoned at the scrape deadline
+func TestServerHealthCheck(t *testing.T) {
+
+	defer func(path string, deadline time.Duration) { serverHealthPath, scrapeDeadline = path, deadline }(serverHealthPath, scrapeDeadline)
+	scrapeDeadline = 500 * time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+			}
+		}
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer srv.Close()
+
+	serverHealthPath = ""
+	calls := gaugeValue(gatherFamilies(t, newTestExporter(srv.URL+"/v2-beta"))["rancher_api_calls"])
+
+	serverHealthPath = "/ping"
+	start := time.Now()
+	mfs := gatherFamilies(t, newTestExporter(srv.URL+"/v2-beta"))
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the health check to be abandoned at the scrape deadline, the scrape took %s", elapsed)
+	}
+	if v := gaugeValue(mfs["rancher_server_healthy"]); v != 0 {
+		t.Errorf("expected rancher_server_healthy 0, got %v", v)
+	}
+	if v := gaugeValue(mfs["rancher_api_calls"]); v != calls+1 {
+		t.Errorf("expected the health check in rancher_api_calls, got %v after %v without it", v, calls)
+	}
+}
@@ -1,19 +1,35 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 
 	"github.com/infinityworks/prometheus-rancher-exporter/measure"
 )
 
 const (
-	namespace = "rancher" // Used to prepand Prometheus metrics created by this exporter.
+	namespace    = "rancher" // Used to prepand Prometheus metrics created by this exporter.
+	unknownStack = "unknown" // Placeholder used as the stack_name when a stack cannot be resolved.
+
+	unknownEnvironment = "unknown" // Placeholder used as the environment when a host's environment cannot be resolved.
+	unknownService     = "unknown" // Placeholder used as the service_name when a container's service cannot be resolved.
+	unknownHost        = "unknown" // Placeholder used as the host when a container's host cannot be resolved.
+
+	responseAlpha = 0.3 // Weight of the latest response in the moving average response time, higher values react faster.
 )
 
 // Runtime variables, user controllable for targeting, authentication and filtering.
@@ -23,9 +39,89 @@ var (
 	rancherURL    = os.Getenv("CATTLE_URL")            // URL of Rancher Server API e.g. http://192.168.0.1:8080/v2-beta
 	accessKey     = os.Getenv("CATTLE_ACCESS_KEY")     // Optional - Access Key for Rancher API
 	secretKey     = os.Getenv("CATTLE_SECRET_KEY")     // Optional - Secret Key for Rancher API
+	environmentID = os.Getenv("CATTLE_ENVIRONMENT_ID") // Optional - Environment (project) ID, gathers via /projects/<id>/ paths when set
+	apiMode       = getEnv("API_VERSION", "v2-beta")   // Optional - API the exporter gathers from, v2-beta for Rancher 1.x or v3 for Rancher 2.x
 	log           = logrus.New()
 	logLevel      = getEnv("LOG_LEVEL", "info")                   // Optional - Set the logging level
 	hideSys, _    = strconv.ParseBool(getEnv("HIDE_SYS", "true")) // hideSys - Optional - Flag that indicates if the environment variable `HIDE_SYS` is set to a boolean true value
+
+	countSys, _     = strconv.ParseBool(getEnv("COUNT_SYS", "false"))            // Optional - Include system objects hidden by `HIDE_SYS` in the aggregate counts
+	staleCounts, _  = strconv.ParseBool(getEnv("STALE_COUNTS", "false"))         // Optional - Re-emit the last successful counts when a scrape fails
+	probeMetrics, _ = strconv.ParseBool(getEnv("PROBE_METRICS", "false"))        // Optional - Emit blackbox_exporter style probe_success and probe_duration_seconds
+	snapshotJSON, _ = strconv.ParseBool(getEnv("SNAPSHOT_JSON", "false"))        // Optional - Serve the last gathered data as JSON on /snapshot.json
+	sortObjects, _  = strconv.ParseBool(getEnv("DETERMINISTIC_OUTPUT", "false")) // Optional - Process objects in a stable order, settling label collisions and the snapshot's order
+	emitZero, _     = strconv.ParseBool(getEnv("EMIT_ZERO_COUNTS", "false"))     // Optional - Emit aggregate counts of zero for known states with no objects
+
+	instanceList = splitList(os.Getenv("RANCHER_INSTANCES")) // Optional - Comma separated name=url pairs of Rancher servers to gather, in place of CATTLE_URL
+
+	hostLabelKeys = splitList(os.Getenv("HOST_LABEL_KEYS")) // Optional - Comma separated allowlist of host label keys to aggregate hosts by
+
+	hostSelectorValue = os.Getenv("HOST_SELECTOR") // Optional - Label selector restricting the hosts that produce metrics e.g. role=worker,zone!=dr
+
+	stackInclude   = os.Getenv("STACK_FILTER")    // Optional - Regex stack names must match to produce metrics
+	stackExclude   = os.Getenv("STACK_EXCLUDE")   // Optional - Regex of stack names left out, along with their services
+	serviceInclude = os.Getenv("SERVICE_FILTER")  // Optional - Regex service names must match to produce metrics
+	serviceExclude = os.Getenv("SERVICE_EXCLUDE") // Optional - Regex of service names left out
+
+	fieldMapList = splitList(os.Getenv("FIELD_MAP")) // Optional - Comma separated field=key pairs, sourcing metric inputs from other JSON keys
+
+	onUnknownState = getEnv("ON_UNKNOWN_STATE", "warn") // Optional - Whether a state missing from the known states is warned about, fails the scrape or is ignored
+
+	mismatchList = splitList(getEnv("SERVICE_MISMATCH_RULES", "active:unhealthy,active:degraded")) // Optional - Comma separated state:healthState pairs considered a mismatch
+
+	containerMetrics, _ = strconv.ParseBool(getEnv("CONTAINER_METRICS", "false")) // Optional - Also gather the containers endpoint, one series per container
+
+	certificateMetrics, _ = strconv.ParseBool(getEnv("CERTIFICATE_METRICS", "false")) // Optional - Also gather the certificates endpoint, exposing when each certificate expires
+
+	scrapeTimeout, _ = time.ParseDuration(getEnv("CATTLE_SCRAPE_TIMEOUT", "10s")) // Optional - Timeout of each request to the Rancher API, including reading the response
+
+	maxAttempts, _  = strconv.Atoi(getEnv("RETRY_ATTEMPTS", "3"))          // Optional - Attempts made at each API request before a transient failure fails the endpoint
+	retryBackoff, _ = time.ParseDuration(getEnv("RETRY_BACKOFF", "500ms")) // Optional - Wait before retrying a failed API request, doubled on each further retry
+
+	refreshInterval, _ = time.ParseDuration(getEnv("API_REFRESH_INTERVAL", "0s")) // Optional - Poll the API in the background on this interval, serving scrapes from the last refresh
+
+	pollJitterValue = os.Getenv("POLL_JITTER") // Optional - Most time the first background refresh is delayed by, defaults to API_REFRESH_INTERVAL
+
+	refreshToken          = os.Getenv("REFRESH_TOKEN")                                // Optional - Bearer token enabling POST /refresh, triggering a refresh ahead of API_REFRESH_INTERVAL
+	refreshTimeout, _     = time.ParseDuration(getEnv("REFRESH_TIMEOUT", "30s"))      // Optional - How long POST /refresh waits for the refresh to complete
+	refreshMinInterval, _ = time.ParseDuration(getEnv("REFRESH_MIN_INTERVAL", "10s")) // Optional - Least time between refreshes triggered through /refresh
+
+	scrapeConcurrency, _ = strconv.Atoi(getEnv("SCRAPE_CONCURRENCY", "4"))      // Optional - Most endpoints gathered at once
+	scrapeDeadline, _    = time.ParseDuration(getEnv("SCRAPE_DEADLINE", "30s")) // Optional - Overall time allowed to gather every endpoint in a scrape
+
+	tlsServerName = os.Getenv("TLS_SERVER_NAME") // Optional - Server name sent via SNI and expected on the Rancher certificate, when connecting by IP
+
+	tlsSkipVerify, _ = strconv.ParseBool(getEnv("RANCHER_TLS_SKIP_VERIFY", "false")) // Optional - Skip verifying the certificate presented by the Rancher API
+	caCertFile       = getEnv("RANCHER_CA_CERT", os.Getenv("CATTLE_CA_CERT_FILE"))   // Optional - PEM bundle of CAs trusted to sign the Rancher API certificate
+	clientCertFile   = os.Getenv("RANCHER_CLIENT_CERT")                              // Optional - PEM client certificate presented to the Rancher API
+	clientKeyFile    = os.Getenv("RANCHER_CLIENT_KEY")                               // Optional - PEM private key of the client certificate
+
+	envCredentialsFile = os.Getenv("ENV_CREDENTIALS_FILE") // Optional - File mapping environment IDs to the API keys used to gather them
+
+	statsdAddress = os.Getenv("STATSD_ADDRESS")        // Optional - host:port of a StatsD server to push aggregate counts to on each scrape
+	statsdPrefix  = getEnv("STATSD_PREFIX", namespace) // Optional - Prefix of the metric names pushed to StatsD
+
+	serverHealthPath = os.Getenv("SERVER_HEALTH_PATH") // Optional - Path of the Rancher server's own health check e.g. /ping, reported as rancher_server_healthy
+
+	disableHTTP2, _ = strconv.ParseBool(getEnv("DISABLE_HTTP2", "false")) // Optional - Only speak HTTP/1.1 to the Rancher API
+
+	maxPages, _ = strconv.Atoi(getEnv("MAX_PAGES", "100")) // Optional - Most pages followed per endpoint, guarding against a misbehaving pagination cursor
+	pageSize, _ = strconv.Atoi(getEnv("PAGE_SIZE", "0"))   // Optional - Objects requested per page, 0 for the API default or -1 for everything in one page
+
+	maxResponseBytes, _ = strconv.ParseInt(getEnv("MAX_RESPONSE_BYTES", "268435456"), 10, 64) // Optional - Upper bound on the size of a single API response
+
+	hostLabelKey    = getEnv("LABEL_KEY_HOST", "name")    // Optional - Label key identifying the host in host metrics
+	stackLabelKey   = getEnv("LABEL_KEY_STACK", "name")   // Optional - Label key identifying the stack in stack metrics
+	serviceLabelKey = getEnv("LABEL_KEY_SERVICE", "name") // Optional - Label key identifying the service in service metrics
+
+	listSchemas = flag.Bool("list-endpoints", false, "List the collection endpoints advertised by the Rancher API schema and exit")
+
+	healthWindow, _    = strconv.Atoi(getEnv("HEALTH_WINDOW", "5"))    // Optional - Number of recent scrapes considered by /ready
+	healthThreshold, _ = strconv.Atoi(getEnv("HEALTH_THRESHOLD", "5")) // Optional - Failed scrapes within the window before /ready reports not ready
+
+	shutdownTimeout, _ = time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "30s")) // Optional - Time allowed for in-flight scrapes to complete on SIGTERM
+
+	stuckThreshold, _ = time.ParseDuration(getEnv("STUCK_THRESHOLD", "10m")) // Optional - How long a stack may stay transitioning before it is counted as stuck
 )
 
 // Predefined variables that are used throughout the exporter
@@ -35,8 +131,15 @@ var (
 	stackStates   = []string{"activating", "active", "canceled_upgrade", "canceling_upgrade", "error", "erroring", "finishing_upgrade", "removed", "removing", "requested", "restarting", "rolling_back", "updating_active", "upgraded", "upgrading"}
 	serviceStates = []string{"activating", "active", "canceled_upgrade", "canceling_upgrade", "deactivating", "finishing_upgrade", "inactive", "registering", "removed", "removing", "requested", "restarting", "rolling_back", "updating_active", "updating_inactive", "upgraded", "upgrading"}
 	healthStates  = []string{"healthy", "unhealthy", "initializing", "degraded", "started-once"}
-	endpoints     = []string{"stacks", "services", "hosts"} // EndPoints the exporter will trawl
-	stackRef      = make(map[string]string)                 // Stores the StackID and StackName as a map, used to provide label dimensions to service metrics
+	transitStates = []string{"activating", "canceling_upgrade", "deactivating", "finishing_upgrade", "registering", "removing", "requested", "restarting", "rolling_back", "updating_active", "updating_inactive", "upgrading"}
+	endpoints     = []string{"projects", "stacks", "services", "hosts"} // EndPoints the exporter will trawl
+	acceptTypes   = make(map[string]*regexp.Regexp)                     // Optional regex per endpoint, accepting further object types in checkMetric
+	mismatchRules = make(map[string]bool)                               // state:healthState combinations flagged as a service state/health mismatch
+	fieldMap      = make(map[string]string)                             // Built-in JSON key of a metric input, to the JSON key it is read from instead
+	hostSelector  []requirement                                         // Requirements hosts must meet to produce metrics, parsed from HOST_SELECTOR
+	stackFilter   nameFilter                                            // Stack names producing metrics, compiled from STACK_FILTER and STACK_EXCLUDE
+	serviceFilter nameFilter                                            // Service names producing metrics, compiled from SERVICE_FILTER and SERVICE_EXCLUDE
+	envKeys       = make(map[string]credentials)                        // API keys by environment ID, read from ENV_CREDENTIALS_FILE
 
 )
 
@@ -49,32 +152,340 @@ func getEnv(key, fallback string) string {
 	return value
 }
 
+// splitList - Splits a comma separated value into its non-empty, trimmed elements
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func main() {
 	flag.Parse()
 
 	// Sets the logging value for the exporter, defaults to info
 	setLogLevel(logLevel)
 
-	// check the rancherURL ($CATTLE_URL) has been provided correctly
-	if rancherURL == "" {
-		log.Fatal("CATTLE_URL must be set and non-empty")
+	// load the API keys scoped per environment, used in place of the shared keys for the environments they map
+	if envCredentialsFile != "" {
+		creds, err := loadCredentials(envCredentialsFile)
+		if err != nil {
+			log.Fatalf("Invalid ENV_CREDENTIALS_FILE: %s", err)
+		}
+		envKeys = creds
+	}
+
+	// gather either the named instances of RANCHER_INSTANCES, or the single server at CATTLE_URL
+	var instances []instance
+	if len(instanceList) > 0 {
+		parsed, err := parseInstances(instanceList)
+		if err != nil {
+			log.Fatalf("Invalid RANCHER_INSTANCES: %s", err)
+		}
+		instances = parsed
+	} else {
+		// check the rancherURL ($CATTLE_URL) has been provided correctly
+		if rancherURL == "" {
+			log.Fatal("CATTLE_URL or RANCHER_INSTANCES must be set and non-empty")
+		}
+		creds := credentialsFor(environmentID)
+		instances = []instance{{url: rancherURL, accessKey: creds.accessKey, secretKey: creds.secretKey, environmentID: environmentID}}
+	}
+
+	// check a unix socket, if used in place of the rancherURL, exists
+	for _, in := range instances {
+		if socketPath, _ := unixSocketURL(in.url); socketPath != "" {
+			info, err := os.Stat(socketPath)
+			if err != nil {
+				log.Fatalf("Unable to use Rancher API socket: %s", err)
+			}
+			if info.Mode()&os.ModeSocket == 0 {
+				log.Fatalf("Unable to use Rancher API socket: %s is not a unix socket", socketPath)
+			}
+		}
+	}
+
+	// check the API version and, for Rancher 2.x, switch to its collections
+	switch apiMode {
+	case "v2-beta":
+	case "v3":
+		endpoints = v3Endpoints
+	default:
+		log.Fatalf("Invalid API_VERSION %q, expected v2-beta or v3", apiMode)
+	}
+
+	// certificates are labelled by environment, so are gathered once the projects are stored
+	if certificateMetrics && apiMode != "v3" {
+		endpoints = append(endpoints, "certificates")
+	}
+
+	// containers are gathered last, once the services and hosts they refer to are stored
+	if containerMetrics && apiMode != "v3" {
+		endpoints = append(endpoints, "containers")
+	}
+
+	// compile any per endpoint accepted type overrides e.g. ACCEPT_TYPE_SERVICES=.*Service$
+	for _, p := range endpoints {
+		key := "ACCEPT_TYPE_" + strings.ToUpper(p)
+		if pattern := os.Getenv(key); pattern != "" {
+			r, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Fatalf("Invalid regex in %s: %s", key, err)
+			}
+			acceptTypes[p] = r
+		}
+	}
+
+	// check the server health path is relative to the server root
+	if serverHealthPath != "" && !strings.HasPrefix(serverHealthPath, "/") {
+		log.Fatalf("Invalid SERVER_HEALTH_PATH %q, expected a path such as /ping", serverHealthPath)
+	}
+
+	// parse the host selector, failing fast on invalid syntax
+	selector, err := parseSelector(hostSelectorValue)
+	if err != nil {
+		log.Fatalf("Invalid HOST_SELECTOR: %s", err)
+	}
+	hostSelector = selector
+
+	// compile the stack and service filters, failing fast on an invalid regex
+	if stackFilter, err = newNameFilter("STACK_FILTER", stackInclude, "STACK_EXCLUDE", stackExclude); err != nil {
+		log.Fatalf("Invalid regex in %s", err)
+	}
+	if serviceFilter, err = newNameFilter("SERVICE_FILTER", serviceInclude, "SERVICE_EXCLUDE", serviceExclude); err != nil {
+		log.Fatalf("Invalid regex in %s", err)
+	}
+
+	// check the unknown state behaviour is one we recognise
+	if onUnknownState != "warn" && onUnknownState != "fail" && onUnknownState != "ignore" {
+		log.Fatalf("Invalid ON_UNKNOWN_STATE %q, expected one of warn, fail or ignore", onUnknownState)
+	}
+
+	// parse any remapped fields e.g. FIELD_MAP=scale=desiredScale
+	for _, pair := range fieldMapList {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			log.Fatalf("Invalid FIELD_MAP entry %q, expected field=key", pair)
+		}
+		known := false
+		for _, f := range mappableFields {
+			if kv[0] == f {
+				known = true
+			}
+		}
+		if !known {
+			log.Fatalf("Invalid FIELD_MAP field %q, expected one of %s", kv[0], strings.Join(mappableFields, ", "))
+		}
+		fieldMap[kv[0]] = kv[1]
+	}
+
+	// parse the service state/health combinations considered a mismatch
+	for _, rule := range mismatchList {
+		if strings.Count(rule, ":") != 1 {
+			log.Fatalf("Invalid SERVICE_MISMATCH_RULES entry %q, expected state:healthState", rule)
+		}
+		mismatchRules[rule] = true
+	}
+
+	// check the page cap allows at least the first page
+	if maxPages < 1 {
+		log.Fatal("MAX_PAGES must be a positive number of pages")
+	}
+
+	// check the page size is one the API understands
+	if pageSize < -1 {
+		log.Fatal("PAGE_SIZE must be a positive number of objects, 0 for the API default or -1 for no limit")
+	}
+
+	// check the response size limit is usable
+	if maxResponseBytes < 1 {
+		log.Fatal("MAX_RESPONSE_BYTES must be a positive number of bytes")
+	}
+
+	// check the health window and threshold are usable
+	if healthWindow < 1 || healthThreshold < 1 || healthThreshold > healthWindow {
+		log.Fatal("HEALTH_WINDOW and HEALTH_THRESHOLD must be positive, with HEALTH_THRESHOLD no greater than HEALTH_WINDOW")
+	}
+
+	// check the request timeout parsed as a usable duration
+	if scrapeTimeout <= 0 {
+		log.Fatal("CATTLE_SCRAPE_TIMEOUT must be a positive duration, e.g. 10s")
+	}
+
+	// check the refresh interval, zero leaving the API to be gathered on each scrape
+	if refreshInterval < 0 {
+		log.Fatal("API_REFRESH_INTERVAL must be a duration of zero or more, e.g. 30s")
+	}
+
+	// parse the jitter applied to the first background refresh, spreading it across the interval unless set
+	pollJitter := refreshInterval
+	if pollJitterValue != "" {
+		if pollJitter, err = time.ParseDuration(pollJitterValue); err != nil || pollJitter < 0 {
+			log.Fatal("POLL_JITTER must be a duration of zero or more, e.g. 15s")
+		}
+	}
+
+	// check the refresh webhook has a background refresh to trigger, with a usable timeout and rate limit
+	if refreshToken != "" {
+		if refreshInterval == 0 {
+			log.Fatal("REFRESH_TOKEN requires API_REFRESH_INTERVAL to be set, scrapes otherwise always gather the API")
+		}
+		if refreshTimeout <= 0 {
+			log.Fatal("REFRESH_TIMEOUT must be a positive duration, e.g. 30s")
+		}
+		if refreshMinInterval < 0 {
+			log.Fatal("REFRESH_MIN_INTERVAL must be a duration of zero or more, e.g. 10s")
+		}
+	}
+
+	// check the retry policy makes at least one attempt, without waiting a negative time
+	if maxAttempts < 1 {
+		log.Fatal("RETRY_ATTEMPTS must be at least 1")
+	}
+	if retryBackoff < 0 {
+		log.Fatal("RETRY_BACKOFF must be a duration of zero or more, e.g. 500ms")
+	}
+
+	// check the concurrency and overall deadline are usable
+	if scrapeConcurrency < 1 {
+		log.Fatal("SCRAPE_CONCURRENCY must be at least 1")
+	}
+	if scrapeDeadline <= 0 {
+		log.Fatal("SCRAPE_DEADLINE must be a positive duration, e.g. 30s")
+	}
+
+	// check the shutdown timeout parsed as a usable duration
+	if shutdownTimeout <= 0 {
+		log.Fatal("SHUTDOWN_TIMEOUT must be a positive duration, e.g. 30s")
+	}
+
+	// check the stuck threshold parsed as a usable duration
+	if stuckThreshold <= 0 {
+		log.Fatal("STUCK_THRESHOLD must be a positive duration, e.g. 10m")
+	}
+
+	// check the configured label keys are valid and don't collide with the other labels of the metrics they are added to
+	for _, k := range []string{hostLabelKey, stackLabelKey, serviceLabelKey} {
+		if !model.LabelName(k).IsValid() {
+			log.Fatalf("Invalid label key %q, label keys must match [a-zA-Z_][a-zA-Z0-9_]*", k)
+		}
+	}
+	if err := checkLabelKeys(len(instanceList) > 0); err != nil {
+		log.Fatalf("LABEL_KEY_HOST, LABEL_KEY_STACK or LABEL_KEY_SERVICE conflicts with a label already used by the exporter: %s", err)
 	}
 
 	log.Info("Starting Prometheus Exporter for Rancher")
-	log.Info("Runtime Configuration in-use: URL of Rancher Server: ", rancherURL, " AccessKey: ", accessKey, "System Services hidden: ", hideSys)
+	for _, in := range instances {
+		log.Info("Runtime Configuration in-use: URL of Rancher Server: ", in.url, " AccessKey: ", redact(in.accessKey), " System Services hidden: ", hideSys)
+	}
 
 	// Register internal metrics used for tracking the exporter performance
 	measure.Init()
 
-	// Register a new Exporter
-	Exporter := newExporter(rancherURL, accessKey, secretKey, hideSys)
+	// Build the TLS configuration up front, failing loudly on a CA bundle or client certificate that can't be used
+	tlsConfig, err := newTLSConfig(!tlsSkipVerify, caCertFile, clientCertFile, clientKeyFile, tlsServerName)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %s", err)
+	}
+	if tlsSkipVerify {
+		log.Warn("RANCHER_TLS_SKIP_VERIFY is enabled, the certificate presented by the Rancher API will not be verified")
+	}
+	if os.Getenv("CATTLE_TLS_VERIFY") != "" {
+		log.Warn("CATTLE_TLS_VERIFY is no longer read, the certificate presented by the Rancher API is verified unless RANCHER_TLS_SKIP_VERIFY is set")
+	}
+
+	// Create an Exporter for each instance
+	var exporters instanceSet
+	for _, in := range instances {
+		Exporter := newExporter(in.url, in.accessKey, in.secretKey, tlsConfig, in.environmentID, hideSys, staleCounts, probeMetrics, emitZero, healthWindow, healthThreshold, stuckThreshold)
+		Exporter.instance = in.name
 
-	// Register Metrics from each of the endpoints
-	// This invokes the Collect method through the prometheus client libraries.
-	prometheus.MustRegister(Exporter)
+		// Optional StatsD sink, fed by each successful scrape and prefixed by the instance name when there is one
+		if statsdAddress != "" {
+			prefix := statsdPrefix
+			if in.name != "" {
+				prefix += "." + in.name
+			}
+			sink, err := newStatsdSink(statsdAddress, prefix)
+			if err != nil {
+				log.Fatalf("Unable to use StatsD address %s: %s", statsdAddress, err)
+			}
+			Exporter.statsd = sink
+		}
+
+		exporters = append(exporters, Exporter)
+	}
+
+	// Discovery mode, prints the endpoints the API offers rather than serving metrics
+	if *listSchemas {
+		for _, e := range exporters {
+			if e.instance != "" {
+				log.Infof("Endpoints advertised by instance %s", e.instance)
+			}
+			if err := e.listEndpoints(os.Stdout); err != nil {
+				log.Fatalf("Unable to list endpoints from the Rancher API schema: %s", err)
+			}
+		}
+		return
+	}
+
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, e := range exporters {
+		// Startup self-check, cheaply confirms the API is reachable before the first scrape
+		if err := e.cachedProbe(time.Now()); err != nil {
+			log.Errorf("Startup check against the Rancher API failed: %s", err)
+		}
+
+		// Register Metrics from each of the endpoints
+		// This invokes the Collect method through the prometheus client libraries.
+		// Named instances have their metrics told apart by the rancher_instance label.
+		if e.instance == "" {
+			prometheus.MustRegister(e)
+		} else {
+			prometheus.WrapRegistererWith(prometheus.Labels{"rancher_instance": e.instance}, prometheus.DefaultRegisterer).MustRegister(e)
+		}
+
+		// Background refresh, so scrapes no longer call the API themselves.
+		// The first refresh is offset at random, so exporters started together don't poll the API in step.
+		if refreshInterval > 0 {
+			offset := startOffset(jitter, pollJitter)
+			if e.instance != "" {
+				log.Infof("First background refresh of instance %s in %s", e.instance, offset)
+			} else {
+				log.Infof("First background refresh in %s", offset)
+			}
+			go e.runRefresher(refreshInterval, offset)
+		}
+	}
+
+	// Expose the active configuration, for auditing drift across deployments
+	registerConfigMetrics(map[string]bool{
+		"hide_system":      hideSys,
+		"count_system":     countSys,
+		"stale_counts":     staleCounts,
+		"probe_metrics":    probeMetrics,
+		"snapshot_json":    snapshotJSON,
+		"emit_zero_counts": emitZero,
+		"deterministic":    sortObjects,
+		"containers":       containerMetrics,
+		"certificates":     certificateMetrics,
+	})
+	registerEndpointMetrics(endpoints)
 
 	// Setup HTTP handler
-	http.Handle(metricsPath, prometheus.Handler())
+	http.Handle(metricsPath, promhttp.Handler())
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/ready", exporters.readyz)
+	http.HandleFunc("/readyz", exporters.readyz)
+	if snapshotJSON {
+		http.HandleFunc("/snapshot.json", exporters.snapshotJSON)
+	}
+	if refreshToken != "" {
+		http.Handle("/refresh", &refreshWebhook{exporters: exporters, token: refreshToken, timeout: refreshTimeout, minInterval: refreshMinInterval})
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 		                <head><title>Rancher exporter</title></head>
@@ -86,5 +497,27 @@ func main() {
 		              `))
 	})
 	log.Printf("Starting Server on port %s and path %s", listenAddress, metricsPath)
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+	srv := &http.Server{Addr: listenAddress}
+
+	// On SIGTERM stop accepting connections, letting in-flight scrapes complete before exiting.
+	// Signals are subscribed to before serving, so one arriving early isn't missed.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		<-sig
+
+		log.Info("Shutting down, waiting for in-flight scrapes to complete")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down the server: %s", err)
+		}
+		close(done)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// refreshWebhook - Serves POST /refresh, refreshing every instance straight away rather than waiting for the next interval
+type refreshWebhook struct {
+	exporters   instanceSet
+	token       string
+	timeout     time.Duration
+	minInterval time.Duration
+	mutex       sync.Mutex
+	last        time.Time
+}
+
+// ServeHTTP - Triggers the refresh, answering once every instance has refreshed or the timeout passes.
+// Callers must present the token as a bearer token, and are turned away with a 429 within minInterval of the last refresh.
+func (h *refreshWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "refresh must be requested with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) != 1 {
+		http.Error(w, "missing or invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	h.mutex.Lock()
+	if wait := h.minInterval - time.Since(h.last); wait > 0 {
+		h.mutex.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		http.Error(w, "refreshed too recently, try again later", http.StatusTooManyRequests)
+		return
+	}
+	h.last = time.Now()
+	h.mutex.Unlock()
+
+	log.Infof("Refresh requested by %s", r.RemoteAddr)
+
+	// The refreshes carry on in the background should the timeout pass first
+	results := make(chan bool, len(h.exporters))
+	for _, e := range h.exporters {
+		go func(e *Exporter) {
+			results <- e.refreshCache()
+		}(e)
+	}
+
+	timeout := time.NewTimer(h.timeout)
+	defer timeout.Stop()
+
+	failed := 0
+	for range h.exporters {
+		select {
+		case ok := <-results:
+			if !ok {
+				failed++
+			}
+		case <-timeout.C:
+			http.Error(w, "refresh did not complete within REFRESH_TIMEOUT, it continues in the background", http.StatusGatewayTimeout)
+			return
+		}
+	}
+
+	if failed > 0 {
+		http.Error(w, fmt.Sprintf("refresh failed for %d of %d instances", failed, len(h.exporters)), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
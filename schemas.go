@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Schemas is used to store the collection schemas advertised by the Rancher API
+type Schemas struct {
+	Data []struct {
+		ID                string   `json:"id"`
+		CollectionMethods []string `json:"collectionMethods"`
+		Links             struct {
+			Collection string `json:"collection"`
+		} `json:"links"`
+	} `json:"data"`
+}
+
+// listEndpoints - Prints the collection endpoints advertised by the API schema as a table,
+// flagging those gathered by the exporter
+func (e *Exporter) listEndpoints(w io.Writer) error {
+
+	url := strings.Replace(e.rancherURL, "v1", "v2-beta", 1) + "/schemas"
+
+	var schemas Schemas
+	if err := e.getJSON(context.Background(), url, "schemas", e.accessKey, e.secretKey, &schemas); err != nil {
+		return err
+	}
+
+	sort.Slice(schemas.Data, func(i, j int) bool {
+		return schemas.Data[i].ID < schemas.Data[j].ID
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tTYPE\tGATHERED")
+	for _, s := range schemas.Data {
+
+		// Only schemas that can be listed are collection endpoints
+		if s.Links.Collection == "" || !hasMethod(s.CollectionMethods, "GET") {
+			continue
+		}
+
+		endpoint := path.Base(s.Links.Collection)
+		gathered := "no"
+		for _, p := range endpoints {
+			if p == endpoint {
+				gathered = "yes"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", endpoint, s.ID, gathered)
+	}
+	return tw.Flush()
+}
+
+// hasMethod - Checks whether the HTTP method is one the schema allows
+func hasMethod(methods []string, method string) bool {
+
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
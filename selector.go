@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// requirement - A single equality (key=value) or inequality (key!=value) term of a label selector
+type requirement struct {
+	key   string
+	value string
+	equal bool
+}
+
+// parseSelector - Parses a comma separated label selector, e.g. role=worker,zone!=dr
+func parseSelector(selector string) ([]requirement, error) {
+
+	var reqs []requirement
+	for _, term := range splitList(selector) {
+		r := requirement{equal: true}
+
+		kv := strings.SplitN(term, "!=", 2)
+		if len(kv) == 2 {
+			r.equal = false
+		} else {
+			kv = strings.SplitN(term, "=", 2)
+		}
+
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.ContainsAny(kv[1], "=!") {
+			return nil, fmt.Errorf("invalid selector term %q, expected key=value or key!=value", term)
+		}
+		r.key = strings.TrimSpace(kv[0])
+		r.value = strings.TrimSpace(kv[1])
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// matchesSelector - Checks the labels meet every requirement, an absent label never equals a value
+func matchesSelector(reqs []requirement, labels map[string]string) bool {
+
+	for _, r := range reqs {
+		v, ok := labels[r.key]
+		if r.equal && (!ok || v != r.value) {
+			return false
+		}
+		if !r.equal && ok && v == r.value {
+			return false
+		}
+	}
+	return true
+}
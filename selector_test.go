@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseSelector - Terms parse to their requirements, any malformed term failing the whole selector
+func TestParseSelector(t *testing.T) {
+
+	tests := []struct {
+		selector string
+		want     []requirement
+		invalid  bool
+	}{
+		{"", nil, false},
+		{"role=worker", []requirement{{"role", "worker", true}}, false},
+		{" role = worker , zone!=dr ", []requirement{{"role", "worker", true}, {"zone", "dr", false}}, false},
+		{"role=", []requirement{{"role", "", true}}, false},
+		{"role", nil, true},
+		{"=worker", nil, true},
+		{"role==worker", nil, true},
+		{"role=worker=1", nil, true},
+		{"role!=worker=1", nil, true},
+		{"role=!worker", nil, true},
+		{"role=worker,zone", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSelector(tt.selector)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseSelector(%q): expected an error, got %v", tt.selector, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSelector(%q): %s", tt.selector, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSelector(%q) = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+// TestMatchesSelector - Every requirement must hold, a host without the label never equalling a value
+func TestMatchesSelector(t *testing.T) {
+
+	reqs, err := parseSelector("role=worker,zone!=dr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{map[string]string{"role": "worker", "zone": "eu"}, true},
+		{map[string]string{"role": "worker"}, true},
+		{map[string]string{"role": "worker", "zone": "dr"}, false},
+		{map[string]string{"role": "db", "zone": "eu"}, false},
+		{map[string]string{"zone": "eu"}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesSelector(reqs, tt.labels); got != tt.want {
+			t.Errorf("matchesSelector(%v) = %t, want %t", tt.labels, got, tt.want)
+		}
+	}
+	if !matchesSelector(nil, nil) {
+		t.Error("expected an empty selector to match every host")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// snapshot - The data gathered from each endpoint during the last successful scrape
+type snapshot struct {
+	mutex     sync.RWMutex
+	Timestamp time.Time        `json:"timestamp"`
+	Endpoints map[string]*Data `json:"endpoints"`
+}
+
+// store - Replaces the snapshot with the data from a successful scrape
+func (s *snapshot) store(endpoints map[string]*Data) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Timestamp = time.Now()
+	s.Endpoints = endpoints
+}
+
+// snapshotJSON - Returns the data gathered during the last successful scrape as JSON
+func (e *Exporter) snapshotJSON(w http.ResponseWriter, r *http.Request) {
+
+	e.snapshot.mutex.RLock()
+	defer e.snapshot.mutex.RUnlock()
+
+	if e.snapshot.Endpoints == nil {
+		http.Error(w, "no successful scrape yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&e.snapshot); err != nil {
+		log.Errorf("Error encoding snapshot: %s", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// statsdSink - Pushes the aggregate object counts to StatsD as gauges, alongside the Prometheus exposition
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// newStatsdSink - Creates the sink, StatsD is sent over UDP so this doesn't need the server to be up
+func newStatsdSink(address string, prefix string) (*statsdSink, error) {
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{conn: conn, prefix: prefix}, nil
+}
+
+// knownStates - The states each endpoint sent to StatsD is known to report, sent as zero when no object is in them
+var knownStates = map[string][]string{
+	"hosts":    hostStates,
+	"stacks":   stackStates,
+	"services": serviceStates,
+}
+
+// send - Emits the count of hosts, stacks and services in each state processed by a scrape,
+// e.g. rancher.services.state.active:12|g. The counts are of the objects left once the type check, HOST_SELECTOR,
+// the stack and service filters and HIDE_SYS have been applied, the same objects behind the Prometheus metrics.
+func (s *statsdSink) send(objectStates map[string]map[string]int) {
+
+	for _, endpoint := range []string{"hosts", "stacks", "services"} {
+		states, ok := objectStates[endpoint]
+		if !ok {
+			continue
+		}
+
+		// Known states are sent as zero, so a state emptying out is seen rather than left at its last value
+		counts := make(map[string]int)
+		for _, state := range knownStates[endpoint] {
+			counts[state] = 0
+		}
+		for state, count := range states {
+			counts[state] += count
+		}
+
+		names := make([]string, 0, len(counts))
+		for state := range counts {
+			names = append(names, state)
+		}
+		sort.Strings(names)
+
+		for _, state := range names {
+			line := fmt.Sprintf("%s.%s.state.%s:%d|g", s.prefix, endpoint, state, counts[state])
+			if _, err := s.conn.Write([]byte(line)); err != nil {
+				log.Debugf("Error sending %s to StatsD: %s", line, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// newTLSConfig - Builds the TLS configuration used to talk to the Rancher API, loading any CA bundle and client certificate.
+// A CA bundle that can't be used is an error rather than a silent fall back to skipping verification.
+func newTLSConfig(verify bool, caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+
+	config := &tls.Config{
+		InsecureSkipVerify: !verify,
+		ServerName:         serverName,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid PEM certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	// The certificate and key come as a pair, one without the other is a mistake
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("a client certificate needs both RANCHER_CLIENT_CERT and RANCHER_CLIENT_KEY")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// v3Endpoints - The Rancher 2.x collections gathered in v3 mode, workloads being listed per project
+var v3Endpoints = []string{"clusters", "nodes", "projects", "workloads"}
+
+// scrapeV3 - Gathers the Rancher 2.x (v3) API concurrently, then processes it in order so cluster and project names
+// are stored first. Returns false if any of the endpoints failed, with partial set when the metrics of the endpoints
+// that succeeded have been kept.
+func (e *Exporter) scrapeV3(ctx context.Context, ch chan<- prometheus.Metric) (success bool, partial bool) {
+
+	// Data gathered from each endpoint, kept for the snapshot endpoint
+	gathered := make(map[string]*Data, len(v3Endpoints))
+
+	// Cluster and project names by ID, used as label dimensions for the objects within them
+	clusters := make(map[string]string)
+	projects := make(map[string]string)
+
+	collections := []string{"clusters", "nodes", "projects"}
+	results := gatherEach(len(collections), func(i int) (*Data, error) {
+		return e.gatherData(ctx, e.rancherURL, e.accessKey, e.secretKey, collections[i], ch)
+	})
+
+	success = true
+	for i, p := range collections {
+		r := results[i]
+		e.gaugeVecs["endpointScrapeDuration"].WithLabelValues(p).Set(r.duration.Seconds())
+
+		if r.err != nil {
+			log.Error("Error getting JSON from URL ", p)
+			e.scrapeFailed(p)
+			e.gaugeVecs["endpointUp"].WithLabelValues(p).Set(0)
+			success = false
+			continue
+		}
+		gathered[p] = r.data
+
+		e.processV3(r.data, p, clusters, projects)
+		log.Infof("Metrics successfully processed for %s", p)
+		e.gaugeVecs["endpointUp"].WithLabelValues(p).Set(1)
+		partial = true
+	}
+
+	// Workloads only exist within a project, so can't be gathered without the projects
+	if gathered["projects"] == nil {
+		e.gaugeVecs["endpointUp"].WithLabelValues("workloads").Set(0)
+		return false, partial
+	}
+
+	// Workloads are gathered from each project, concurrently
+	start := time.Now()
+	inProject := gathered["projects"].Data
+	workloadResults := gatherEach(len(inProject), func(i int) (*Data, error) {
+		return e.gatherURL(ctx, withPageSize(e.rancherURL+"/project/"+inProject[i].ID+"/workloads"), "workloads", e.accessKey, e.secretKey)
+	})
+	e.gaugeVecs["endpointScrapeDuration"].WithLabelValues("workloads").Set(time.Since(start).Seconds())
+
+	workloads := new(Data)
+	for i, r := range workloadResults {
+		if r.err != nil {
+			log.Errorf("Error getting workloads for project %s", inProject[i].ID)
+			e.scrapeFailed("workloads")
+			e.gaugeVecs["endpointUp"].WithLabelValues("workloads").Set(0)
+			return false, partial
+		}
+		workloads.Data = append(workloads.Data, r.data.Data...)
+	}
+	gathered["workloads"] = workloads
+
+	e.processV3(workloads, "workloads", clusters, projects)
+	log.Infof("Metrics successfully processed for %s", "workloads")
+	e.gaugeVecs["endpointUp"].WithLabelValues("workloads").Set(1)
+
+	if !success {
+		return false, true
+	}
+
+	e.snapshot.store(gathered)
+
+	return true, false
+}
+
+// processV3 - Sets the state metrics for the objects of a v3 endpoint, storing cluster and project names as it goes
+func (e *Exporter) processV3(data *Data, endpoint string, clusters map[string]string, projects map[string]string) {
+
+	for _, x := range data.Data {
+
+		switch endpoint {
+		case "clusters":
+			clusters[x.ID] = x.Name
+			e.gaugeVecs["clusterState"].WithLabelValues(x.Name, x.State).Set(1)
+
+		case "nodes":
+			// Nodes are commonly unnamed, falling back to the Kubernetes node name then hostname
+			name := x.Name
+			if name == "" {
+				name = x.NodeName
+			}
+			if name == "" {
+				name = x.HostName
+			}
+			e.gaugeVecs["nodeState"].WithLabelValues(name, lookupRef(clusters, x.ClusterID), x.State).Set(1)
+
+		case "projects":
+			projects[x.ID] = x.Name
+			e.gaugeVecs["projectState"].WithLabelValues(x.Name, lookupRef(clusters, x.ClusterID), x.State).Set(1)
+
+		case "workloads":
+			project := lookupRef(projects, x.ProjectID)
+			e.gaugeVecs["workloadState"].WithLabelValues(x.Name, project, x.NamespaceID, x.State).Set(1)
+			e.gaugeVecs["workloadScale"].WithLabelValues(x.Name, project, x.NamespaceID).Set(float64(x.Scale))
+		}
+	}
+}
+
+// lookupRef - Returns the name stored against the ID, or unknown when it cannot be resolved
+func lookupRef(ref map[string]string, id string) string {
+
+	if value, ok := ref[id]; ok && id != "" {
+		return value
+	}
+	return "unknown"
+}